@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker"
@@ -30,6 +33,10 @@ const (
 
 	DefaultServerHost = "127.0.0.1"
 	DefaultServerPort = 4000
+
+	DefaultStateFile = "atlas-broker-state.json"
+
+	DefaultTemplatePollInterval = "1m"
 )
 
 func main() {
@@ -57,7 +64,17 @@ func main() {
 		return
 	}
 
-	startBrokerServer()
+	switch flag.Arg(0) {
+	case "":
+		startBrokerServer()
+	case "reconcile":
+		os.Exit(runReconcile(flag.Args()[1:]))
+	case "plans":
+		os.Exit(runPlans(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s\n", flag.Arg(0), getHelpMessage())
+		os.Exit(2)
+	}
 }
 
 func getHelpMessage() string {
@@ -67,6 +84,16 @@ This is a Service Broker which provides access to MongoDB deployments running
 in MongoDB Atlas. It conforms to the Open Service Broker specification and can
 be used with any compatible platform, for example the Kubernetes Service Catalog.
 
+Commands:
+  (none)              Start the broker server.
+  reconcile [--fix]   Report instance records and Atlas resources which are
+                      out of sync, optionally fixing them.
+  plans lint          Render and check the plan templates without contacting
+                      Atlas. Options: --dir DIR, --context FILE (repeatable).
+  plans render PLAN   Print a plan as it would be provisioned, with secrets
+                      redacted. Options: --dir DIR, --params FILE,
+                      --context FILE, --instance-id ID.
+
 For instructions on how to install and use the Service Broker please refer to
 the documentation: https://docs.mongodb.com/atlas-open-service-broker
 
@@ -107,7 +134,58 @@ func deduceCredentials(logger *zap.SugaredLogger) *credentials.Credentials {
 	return nil
 }
 
-func deduceModeAndCreds(logger *zap.SugaredLogger, baseURL string) (mode broker.Mode, creds *credentials.Credentials, client *mongo.Client) {
+// createStateStore selects the backend used to persist broker metadata.
+// MongoDB is used by default if a DB connection is configured in the
+// credentials. It returns nil if no backend is available.
+func createStateStore(logger *zap.SugaredLogger, db string) broker.StateStore {
+	backend := getEnvOrDefault("BROKER_STATE_STORE", "")
+	if backend == "" && db != "" {
+		backend = "mongodb"
+	}
+
+	switch backend {
+	case "":
+		return nil
+
+	case "mongodb":
+		if db == "" {
+			logger.Fatal("Cannot use MongoDB state store without DB connection")
+		}
+
+		client, err := mongo.NewClient(options.Client().ApplyURI(db))
+		if err != nil {
+			logger.Fatalf("Cannot create Mongo client: %v", err)
+		}
+
+		err = client.Connect(context.Background())
+		if err != nil {
+			logger.Fatalf("Cannot connect to Mongo database: %v", err)
+		}
+
+		logger.Infow("Selected state store", "backend", backend)
+		return broker.NewMongoStateStore(client)
+
+	case "memory":
+		logger.Warnw("Selected state store", "backend", backend, "warning", "all state will be lost on restart")
+		return broker.NewMemoryStateStore()
+
+	case "file":
+		path := getEnvOrDefault("BROKER_STATE_FILE", DefaultStateFile)
+		state, err := broker.NewFileStateStore(path)
+		if err != nil {
+			logger.Fatalw("Cannot open state file", "path", path, "error", err)
+		}
+
+		logger.Infow("Selected state store", "backend", backend, "path", path)
+		return state
+
+	default:
+		logger.Fatalw("Unknown state store backend", "backend", backend)
+		return nil
+	}
+}
+
+func deduceModeAndCreds(logger *zap.SugaredLogger, baseURL string) (mode broker.Mode, creds *credentials.Credentials, state broker.StateStore) {
 	logger.Info("Deducing catalog mode...")
 
 	dynPlans := false
@@ -118,7 +196,7 @@ func deduceModeAndCreds(logger *zap.SugaredLogger, baseURL string) (mode broker.
 	autoPlans = getEnvOrDefault("BROKER_ENABLE_AUTOPLANSFROMPROJECTS", "") == "true"
 	switch {
 	case err == nil && p == nil:
-		logger.Infow("Rejected Dynamic Plans", "reason", "ATLAS_BROKER_TEMPLATEDIR not set")
+		logger.Infow("Rejected Dynamic Plans", "reason", "no plan template source configured")
 		logger.Info("Trying auto-generated plans...")
 		if autoPlans {
 			logger.Info("Selected auto-generated plans")
@@ -128,7 +206,7 @@ func deduceModeAndCreds(logger *zap.SugaredLogger, baseURL string) (mode broker.
 		}
 	case err == nil:
 		if autoPlans {
-			logger.Fatalw("ATLAS_BROKER_TEMPLATEDIR cannot be used with BROKER_ENABLE_AUTOPLANSFROMPROJECTS")
+			logger.Fatalw("Plan templates cannot be used with BROKER_ENABLE_AUTOPLANSFROMPROJECTS")
 		}
 		logger.Info("Selected Dynamic Plans")
 		dynPlans = true
@@ -149,22 +227,13 @@ func deduceModeAndCreds(logger *zap.SugaredLogger, baseURL string) (mode broker.
 		return broker.BasicAuth, nil, nil
 	}
 
-	if creds.Broker.DB == "" {
+	state = createStateStore(logger, creds.Broker.DB)
+	if state == nil {
 		if dynPlans {
-			logger.Fatal("Cannot use dynamic plans without DB connection")
+			logger.Fatal("Cannot use dynamic plans without a state store")
 		}
 		if !autoPlans {
-			logger.Fatal("Cannot use Multi-Group with static plans and no DB connection")
-		}
-	} else {
-		client, err = mongo.NewClient(options.Client().ApplyURI(creds.Broker.DB))
-		if err != nil {
-			logger.Fatalf("Cannot create Mongo client: %v", err)
-		}
-
-		err = client.Connect(context.Background())
-		if err != nil {
-			logger.Fatalf("Cannot connect to Mongo database: %v", err)
+			logger.Fatal("Cannot use Multi-Group with static plans and no state store")
 		}
 	}
 
@@ -173,29 +242,39 @@ func deduceModeAndCreds(logger *zap.SugaredLogger, baseURL string) (mode broker.
 	}
 
 	if dynPlans {
-		return broker.DynamicPlans, creds, client
+		return broker.DynamicPlans, creds, state
 	}
 
 	if autoPlans {
-		return broker.MultiGroupAutoPlans, creds, client
+		return broker.MultiGroupAutoPlans, creds, state
 	}
-	return broker.MultiGroup, creds, client
+	return broker.MultiGroup, creds, state
 
 }
 
 func createBroker(logger *zap.SugaredLogger) *broker.Broker {
 	baseURL := getEnvOrDefault("ATLAS_BASE_URL", DefaultAtlasBaseURL)
-	mode, creds, client := deduceModeAndCreds(logger, baseURL)
+	mode, creds, state := deduceModeAndCreds(logger, baseURL)
 
 	if mode != broker.DynamicPlans {
 		logger.Fatalw("Only Dynamic Plans are currently supported")
 	}
 
+	// Administrators can limit the number of instances users can provision
+	var quotas *broker.Quotas
+	if path, ok := os.LookupEnv("BROKER_QUOTAS_FILE"); ok {
+		q, err := broker.ReadQuotasFile(path)
+		if err != nil {
+			logger.Fatalw("Cannot load instance quotas", "error", err, "quotas_file", path)
+		}
+		quotas = q
+	}
+
 	// Administrators can control what providers/plans are available to users
 	pathToWhitelistFile, hasWhitelist := os.LookupEnv("PROVIDERS_WHITELIST_FILE")
 	if !hasWhitelist {
 		logger.Infow("Creating broker", "atlas_base_url", baseURL, "whitelist_file", "NONE")
-		return broker.New(logger, creds, baseURL, nil, client, mode)
+		return broker.New(logger, creds, baseURL, nil, quotas, state, mode)
 	}
 
 	whitelist, err := broker.ReadWhitelistFile(pathToWhitelistFile)
@@ -204,7 +283,7 @@ func createBroker(logger *zap.SugaredLogger) *broker.Broker {
 	}
 
 	logger.Infow("Creating broker", "atlas_base_url", baseURL, "whitelist_file", pathToWhitelistFile)
-	return broker.New(logger, creds, baseURL, whitelist, client, mode)
+	return broker.New(logger, creds, baseURL, whitelist, quotas, state, mode)
 }
 
 func startBrokerServer() {
@@ -222,12 +301,20 @@ func startBrokerServer() {
 
 	b := createBroker(logger)
 
+	// Deferred Atlas cleanup runs in the background for the lifetime of the
+	// broker.
+	go b.RunCleanupWorker(context.Background())
+	startReconciler(logger, b)
+	startTemplateReloader(logger, b)
+
 	router := mux.NewRouter()
 	brokerapi.AttachRoutes(router, b, NewLagerZapLogger(logger))
+	b.AttachAdminRoutes(router)
 
 	// The auth middleware will convert basic auth credentials into an Atlas
 	// client.
 	router.Use(b.AuthMiddleware())
+	router.Use(broker.OriginatingIdentityMiddleware())
 
 	// Configure TLS from environment variables.
 	tlsEnabled, tlsCertPath, tlsKeyPath := getTLSConfig(logger)
@@ -254,6 +341,40 @@ func startBrokerServer() {
 	}
 }
 
+// startTemplateReloader reloads the plan templates whenever the template
+// directory changes or the broker receives SIGHUP. Other template sources
+// are polled every ATLAS_BROKER_TEMPLATE_POLL_INTERVAL.
+func startTemplateReloader(logger *zap.SugaredLogger, b *broker.Broker) {
+	src, err := dynamicplans.SourceFromEnv()
+	if err != nil || src == nil {
+		return
+	}
+
+	if dir, ok := src.(dynamicplans.DirSource); ok {
+		if err := b.WatchTemplates(context.Background(), dir.Path); err != nil {
+			logger.Errorw("Cannot watch plan templates, reload with SIGHUP instead", "error", err, "dir", dir.Path)
+		}
+	} else {
+		value := getEnvOrDefault("ATLAS_BROKER_TEMPLATE_POLL_INTERVAL", DefaultTemplatePollInterval)
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			logger.Fatalw("Invalid plan template poll interval", "interval", value, "error", err)
+		}
+
+		go b.PollTemplates(context.Background(), interval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			logger.Info("Received SIGHUP, reloading plan templates")
+			_ = b.ReloadCatalog()
+		}
+	}()
+}
+
 func getTLSConfig(logger *zap.SugaredLogger) (bool, string, string) {
 	certPath := getEnvOrDefault("BROKER_TLS_CERT_FILE", "")
 	keyPath := getEnvOrDefault("BROKER_TLS_KEY_FILE", "")
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+)
+
+// previewInstanceID is the instance ID plans are rendered with if none is
+// given.
+const previewInstanceID = "preview-instance"
+
+// errPlanNotFound is returned by RenderPlan for unknown plans.
+type errPlanNotFound string
+
+func (e errPlanNotFound) Error() string {
+	return fmt.Sprintf("plan %q not found in catalog", string(e))
+}
+
+// RenderPlan renders a plan the same way provisioning does, for the given
+// request parameters and platform context, and returns it with secrets
+// redacted. The plan can be given by ID or by name.
+func (b *Broker) RenderPlan(plan string, instanceID string, rawParameters json.RawMessage, rawContext json.RawMessage) (*dynamicplans.Plan, error) {
+	planID, err := b.findPlanID(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	if instanceID == "" {
+		instanceID = previewInstanceID
+	}
+
+	planContext, err := dynamicplans.NewContext(instanceID, rawParameters, rawContext)
+	if err != nil {
+		return nil, err
+	}
+
+	dp, err := b.parsePlan(instanceID, planContext, planID)
+	if err != nil {
+		return nil, err
+	}
+
+	r := dp.Redacted()
+	return &r, nil
+}
+
+// findPlanID looks up a plan in the catalog by ID or name.
+func (b *Broker) findPlanID(plan string) (string, error) {
+	c := b.getCatalog()
+	if _, ok := c.plans[plan]; ok {
+		return plan, nil
+	}
+
+	for id, p := range c.plans {
+		if p.Name == plan {
+			return id, nil
+		}
+	}
+
+	return "", errPlanNotFound(plan)
+}
+
+// renderRequest is the body of a plan render request.
+type renderRequest struct {
+	InstanceID string          `json:"instance_id"`
+	Parameters json.RawMessage `json:"parameters"`
+	Context    json.RawMessage `json:"context"`
+}
+
+// AttachAdminRoutes adds the admin endpoints to a router. They must be
+// served behind the same authentication as the OSB API.
+func (b *Broker) AttachAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/admin/plans/{plan}/render", b.handleRenderPlan).Methods(http.MethodPost)
+}
+
+// handleRenderPlan renders a plan for the parameters and context in the
+// request body and responds with the redacted plan.
+func (b *Broker) handleRenderPlan(w http.ResponseWriter, r *http.Request) {
+	plan := mux.Vars(r)["plan"]
+
+	req := renderRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+
+	dp, err := b.RenderPlan(plan, req.InstanceID, req.Parameters, req.Context)
+	if _, ok := err.(errPlanNotFound); ok {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	b.logger.Infow("Rendered plan preview", "plan", plan, "instance_id", req.InstanceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dp)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"description": err.Error()})
+}
@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRenderPlanEndpoint(t *testing.T) {
+	dir := useTestTemplateDir(t)
+
+	writeTestTemplate(t, dir, "secret", `name: secret-plan
+description: Plan with secrets
+apiKey:
+  publicKey: public
+  privateKey: very-secret-key
+cluster:
+  name: {{ .instance_name }}
+  providerSettings:
+    providerName: AWS
+    instanceSizeName: {{ default "M10" .instance_size }}
+    regionName: US_EAST_1
+databaseUsers:
+- username: admin
+  password: {{ default "very-secret-password" .password }}
+`)
+
+	b := New(zap.NewNop().Sugar(), nil, "", nil, nil, nil, DynamicPlans)
+	router := mux.NewRouter()
+	b.AttachAdminRoutes(router)
+
+	body := `{"parameters": {"instance_name": "test", "instance_size": "M30"}}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/plans/secret-plan/render", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"instanceSizeName":"M30"`)
+	assert.Contains(t, rec.Body.String(), `"name":"test"`)
+	assert.NotContains(t, rec.Body.String(), "very-secret")
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/plans/unknown/render", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
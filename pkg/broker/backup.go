@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+)
+
+// scheduleBackupPolicy records the backup policy of a dynamic plan in the
+// operation so it is applied once the clusters have reached IDLE. Atlas only
+// accepts snapshot schedules for clusters with cloud provider backups, so the
+// policy is applied to the clusters of the plan with providerBackupEnabled.
+// The plan's clusters are matched with the instance's cluster names by
+// position.
+func (b *Broker) scheduleBackupPolicy(op *operation, planID string, planContext dynamicplans.Context, names []string) error {
+	if op == nil || b.mode != DynamicPlans {
+		return nil
+	}
+
+	dp, err := b.parsePlan(op.InstanceID, planContext, planID)
+	if err != nil {
+		return err
+	}
+
+	if dp.BackupPolicy == nil {
+		return nil
+	}
+
+	for i, c := range dp.AllClusters() {
+		if i >= len(names) {
+			break
+		}
+		if c.ProviderBackupEnabled != nil && *c.ProviderBackupEnabled {
+			op.BackupClusters = append(op.BackupClusters, names[i])
+		}
+	}
+
+	if len(op.BackupClusters) > 0 {
+		op.BackupPolicy = dp.BackupPolicy
+	}
+
+	return nil
+}
+
+// applyBackupPolicy applies the backup policy recorded in the operation as
+// its last step and completes the operation.
+func (b *Broker) applyBackupPolicy(ctx context.Context, op *operation, client *mongodbatlas.Client, gid string) {
+	err := b.runStep(ctx, op, stepApplyBackupPolicy, func() error {
+		for _, name := range op.BackupClusters {
+			if err := updateBackupPolicy(ctx, client, gid, name, op.BackupPolicy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.logger.Errorw("Failed to apply backup policy", "error", err, "instance_id", op.InstanceID, "clusters", op.BackupClusters)
+		return
+	}
+
+	op.succeed()
+	b.saveOperation(ctx, op)
+}
+
+// updateBackupPolicy replaces the snapshot schedule of a cluster. Atlas
+// creates a policy for every cluster and only allows updating it, so policies
+// without an ID take the ID of the existing policy at the same position.
+func updateBackupPolicy(ctx context.Context, client *mongodbatlas.Client, gid string, name string, policy *mongodbatlas.CloudProviderSnapshotBackupPolicy) error {
+	existing, _, err := client.CloudProviderSnapshotBackupPolicies.Get(ctx, gid, name)
+	if err != nil {
+		return err
+	}
+
+	update := *policy
+	update.ClusterID = ""
+	update.ClusterName = ""
+	update.NextSnapshot = ""
+	update.Policies = make([]mongodbatlas.Policy, len(policy.Policies))
+	for i, p := range policy.Policies {
+		if p.ID == "" && i < len(existing.Policies) {
+			p.ID = existing.Policies[i].ID
+		}
+		update.Policies[i] = p
+	}
+
+	_, _, err = client.CloudProviderSnapshotBackupPolicies.Update(ctx, gid, name, &update)
+	return err
+}
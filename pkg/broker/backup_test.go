@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateBackupPolicy(t *testing.T) {
+	var update mongodbatlas.CloudProviderSnapshotBackupPolicy
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/groups/group/clusters/cluster/backup/schedule", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == http.MethodPatch {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&update))
+		}
+		_, _ = w.Write([]byte(`{"clusterName":"cluster","policies":[{"id":"existing"}]}`))
+	}))
+	defer server.Close()
+
+	client, err := mongodbatlas.New(server.Client(), mongodbatlas.SetBaseURL(server.URL+"/"))
+	assert.NoError(t, err)
+
+	days := int64(3)
+	policy := &mongodbatlas.CloudProviderSnapshotBackupPolicy{
+		RestoreWindowDays: &days,
+		Policies: []mongodbatlas.Policy{{PolicyItems: []mongodbatlas.PolicyItem{
+			{FrequencyType: "hourly", FrequencyInterval: 6, RetentionUnit: "days", RetentionValue: 2},
+		}}},
+	}
+
+	err = updateBackupPolicy(context.Background(), client, "group", "cluster", policy)
+	assert.NoError(t, err)
+	assert.Equal(t, "existing", update.Policies[0].ID)
+	assert.Equal(t, policy.Policies[0].PolicyItems, update.Policies[0].PolicyItems)
+	assert.Equal(t, int64(3), *update.RestoreWindowDays)
+
+	// The plan's policy is left untouched.
+	assert.Equal(t, "", policy.Policies[0].ID)
+}
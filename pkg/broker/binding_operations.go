@@ -7,19 +7,68 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"time"
+
 	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
 	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
 	"github.com/pivotal-cf/brokerapi/domain"
 	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
 )
 
+// The different async binding operations that can be performed. These are
+// included in async polls from the platform.
+const (
+	OperationBind   = "bind"
+	OperationUnbind = "unbind"
+)
+
 // ConnectionDetails will be returned when a new binding is created.
 type ConnectionDetails struct {
 	Username         string `json:"username"`
 	Password         string `json:"password"`
 	URI              string `json:"uri"`
 	ConnectionString string `json:"connectionString"`
+
+	// The private connection strings are only included if the plan asks for
+	// them with the privateConnectionStrings setting.
+	PrivateURI              string `json:"privateUri,omitempty"`
+	PrivateConnectionString string `json:"privateConnectionString,omitempty"`
+
+	// Clusters holds the connection details for each cluster, keyed by
+	// cluster name, if the instance has more than one.
+	Clusters map[string]ClusterConnectionDetails `json:"clusters,omitempty"`
+}
+
+// ClusterConnectionDetails are the connection details for one cluster of an
+// instance.
+type ClusterConnectionDetails struct {
+	URI                     string `json:"uri"`
+	ConnectionString        string `json:"connectionString"`
+	PrivateURI              string `json:"privateUri,omitempty"`
+	PrivateConnectionString string `json:"privateConnectionString,omitempty"`
+}
+
+// serviceBinding is the binding record kept in the state store. It allows
+// credentials to be retrieved again after the binding has been created.
+type serviceBinding struct {
+	ID                  string              `bson:"id" json:"id"`
+	InstanceID          string              `bson:"instanceID" json:"instanceID"`
+	PlanID              string              `bson:"planID,omitempty" json:"planID,omitempty"`
+	Username            string              `bson:"username" json:"username"`
+	AuthDB              string              `bson:"authDB" json:"authDB"`
+	Roles               []mongodbatlas.Role `bson:"roles" json:"roles"`
+	Created             time.Time           `bson:"created" json:"created"`
+	OriginatingIdentity string              `bson:"originatingIdentity,omitempty" json:"originatingIdentity,omitempty"`
+	Credentials         ConnectionDetails   `bson:"credentials" json:"credentials"`
+	// Parameters holds the raw JSON parameters passed to Bind.
+	Parameters string `bson:"parameters,omitempty" json:"parameters,omitempty"`
+
+	// Operation and State track the last async operation on the binding.
+	// Bindings created synchronously have State set to succeeded.
+	Operation string                    `bson:"operation,omitempty" json:"operation,omitempty"`
+	State     domain.LastOperationState `bson:"state,omitempty" json:"state,omitempty"`
 }
 
 // Bind will create a new database user with a username matching the binding ID
@@ -27,21 +76,28 @@ type ConnectionDetails struct {
 func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, details domain.BindDetails, asyncAllowed bool) (spec domain.Binding, err error) {
 	b.logger.Infow("Creating binding", "instance_id", instanceID, "binding_id", bindingID, "details", details)
 
-	planContext := dynamicplans.Context{
-		"instance_id": instanceID,
-	}
-	if len(details.RawParameters) > 0 {
-		err = json.Unmarshal(details.RawParameters, &planContext)
-		if err != nil {
+	// A retried bind request must not create a second database user.
+	if b.state != nil {
+		existing := serviceBinding{}
+		err = b.state.Get(ctx, bindingsCollection, bindingID, &existing)
+		switch err {
+		case nil:
+			return b.bindExisting(&existing, instanceID, details)
+		case ErrStateNotFound:
+			err = nil
+		default:
 			return
 		}
 	}
 
-	if len(details.RawContext) > 0 {
-		err = json.Unmarshal(details.RawContext, &planContext)
-		if err != nil {
-			return
-		}
+	err = b.validateParameters(details.PlanID, schemaBind, details.RawParameters)
+	if err != nil {
+		return
+	}
+
+	planContext, err := dynamicplans.NewContext(instanceID, details.RawParameters, details.RawContext)
+	if err != nil {
+		return
 	}
 
 	client, gid, err := b.getClient(ctx, instanceID, details.PlanID, planContext)
@@ -51,34 +107,40 @@ func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, d
 
 	// The service_id and plan_id are required to be valid per the specification, despite
 	// not being used for bindings. We look them up to ensure they can be found in the catalog.
-	_, ok := b.catalog.providers[details.ServiceID]
+	c := b.getCatalog()
+	_, ok := c.providers[details.ServiceID]
 	if !ok {
 		return spec, fmt.Errorf("service ID %q not found in catalog", details.ServiceID)
 	}
 
-    _, ok = b.catalog.plans[details.PlanID]
+    _, ok = c.plans[details.PlanID]
 	if !ok {
 		return spec, fmt.Errorf("plan ID %q not found in catalog", details.PlanID)
 	}
 
-	name, err := b.getClusterNameByInstanceID(ctx, instanceID)
+	names, err := b.getClusterNamesByInstanceID(ctx, instanceID)
 	if err != nil {
 		return
 	}
 
     // Grab the dynamic plan behind this, to check any overrides.
 
-	dp, err := b.parsePlan(nil, details.PlanID)
+	dp, err := b.parsePlan(instanceID, nil, details.PlanID)
     if err != nil {
         return
     }
-    b.logger.Infow("Found dyno plan for bind--->","dp",dp)
-	// Fetch the cluster from Atlas to ensure it exists.
-	cluster, _, err := client.Clusters.Get(ctx, gid, name)
-	if err != nil {
-		b.logger.Errorw("Failed to get existing cluster", "error", err, "instance_id", instanceID)
-		err = atlasToAPIError(err)
-		return
+	b.logger.Debugw("Found plan for binding", "instance_id", instanceID, "plan", dp.Name)
+	// Fetch the clusters from Atlas to ensure they exist.
+	clusters := make([]*mongodbatlas.Cluster, 0, len(names))
+	for _, name := range names {
+		var cluster *mongodbatlas.Cluster
+		cluster, _, err = client.Clusters.Get(ctx, gid, name)
+		if err != nil {
+			b.logger.Errorw("Failed to get existing cluster", "error", err, "instance_id", instanceID)
+			err = atlasToAPIError(err)
+			return
+		}
+		clusters = append(clusters, cluster)
 	}
 
 	// Generate a cryptographically secure random password.
@@ -106,29 +168,78 @@ func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, d
 
 	b.logger.Infow("Successfully created Atlas database user", "instance_id", instanceID, "binding_id", bindingID)
 
-	cs, err := url.Parse(cluster.ConnectionStrings.StandardSrv)
-	if err != nil {
-		b.logger.Errorw("Failed to parse connection string", "error", err, "connString", cluster.ConnectionStrings.StandardSrv)
+	private := dp.Settings[dynamicplans.BROKER_SETTING_PRIVATE_CONNECTION_STRINGS] == "true"
+
+	primary := b.clusterConnection(clusters[0], user, private)
+	credentials := ConnectionDetails{
+		Username:                bindingID,
+		Password:                password,
+		URI:                     primary.URI,
+		ConnectionString:        primary.ConnectionString,
+		PrivateURI:              primary.PrivateURI,
+		PrivateConnectionString: primary.PrivateConnectionString,
 	}
 
-	cs.Path = user.DatabaseName
+	if len(clusters) > 1 {
+		credentials.Clusters = map[string]ClusterConnectionDetails{}
+		for _, c := range clusters {
+			credentials.Clusters[c.Name] = b.clusterConnection(c, user, private)
+		}
+	}
 
-    if len(user.Roles)>0 {
-        cs.Path = user.Roles[0].DatabaseName
-	    b.logger.Infow("Detected roles, override the name of the db to connect", "connectionString", cs)
-    }
+	// Async bindings need the state store to hand out the credentials once
+	// the user has been propagated to the cluster.
+	async := asyncAllowed && b.state != nil
+
+	binding := serviceBinding{
+		ID:                  bindingID,
+		InstanceID:          instanceID,
+		PlanID:              details.PlanID,
+		Username:            user.Username,
+		AuthDB:              user.DatabaseName,
+		Roles:               user.Roles,
+		Created:             time.Now().UTC(),
+		OriginatingIdentity: originatingIdentityFromContext(ctx),
+		Credentials:         credentials,
+		Parameters:          string(details.RawParameters),
+		Operation:           OperationBind,
+		State:               domain.Succeeded,
+	}
 
-	b.logger.Infow("New User ConnectionString", "connectionString", cs)
+	if async {
+		binding.State = domain.InProgress
+	}
 
-	cs.User = url.UserPassword(user.Username, user.Password)
+	if b.state != nil {
+		err = b.state.Put(ctx, bindingsCollection, bindingID, binding)
+		if err != nil {
+			b.logger.Errorw("Failed to store binding", "error", err, "instance_id", instanceID, "binding_id", bindingID)
+
+			// Don't leave behind a user nobody can retrieve credentials for.
+			if _, derr := client.DatabaseUsers.Delete(ctx, user.DatabaseName, gid, user.Username); derr != nil {
+				b.logger.Errorw("Failed to delete Atlas database user", "error", derr, "instance_id", instanceID, "binding_id", bindingID)
+				b.enqueueCleanup(ctx, cleanupTask{
+					Kind:       cleanupDeleteDatabaseUser,
+					GroupID:    gid,
+					InstanceID: instanceID,
+					Target:     user.Username,
+					AuthDB:     user.DatabaseName,
+				}, 0)
+			}
+			return
+		}
+	}
+
+	if async {
+		spec = domain.Binding{
+			IsAsync:       true,
+			OperationData: OperationBind,
+		}
+		return
+	}
 
 	spec = domain.Binding{
-		Credentials: ConnectionDetails{
-			Username:         bindingID,
-			Password:         password,
-			URI:              cluster.SrvAddress,
-			ConnectionString: cs.String(),
-		},
+		Credentials: credentials,
 	}
 	return
 }
@@ -146,21 +257,28 @@ func (b Broker) Unbind(ctx context.Context, instanceID string, bindingID string,
 		return
 	}
 
-	name, err := b.getClusterNameByInstanceID(ctx, instanceID)
+	names, err := b.getClusterNamesByInstanceID(ctx, instanceID)
 	if err != nil {
 		return
 	}
 
-	// Fetch the cluster from Atlas to ensure it exists.
-	_, _, err = client.Clusters.Get(ctx, gid, name)
+	// Fetch the clusters from Atlas to ensure they exist.
+	for _, name := range names {
+		_, _, err = client.Clusters.Get(ctx, gid, name)
+		if err != nil {
+			b.logger.Errorw("Failed to get existing cluster", "error", err, "instance_id", instanceID)
+			err = atlasToAPIError(err)
+			return
+		}
+	}
+
+	authDB, err := b.bindingAuthDB(ctx, bindingID)
 	if err != nil {
-		b.logger.Errorw("Failed to get existing cluster", "error", err, "instance_id", instanceID)
-		err = atlasToAPIError(err)
 		return
 	}
 
 	// Delete database user which has the binding ID as its username.
-	_, err = client.DatabaseUsers.Delete(ctx, "admin", gid, bindingID)
+	_, err = client.DatabaseUsers.Delete(ctx, authDB, gid, bindingID)
 	if err != nil {
 		b.logger.Errorw("Failed to delete Atlas database user", "error", err, "instance_id", instanceID, "binding_id", bindingID)
 		err = atlasToAPIError(err)
@@ -169,23 +287,246 @@ func (b Broker) Unbind(ctx context.Context, instanceID string, bindingID string,
 
 	b.logger.Infow("Successfully deleted Atlas database user", "instance_id", instanceID, "binding_id", bindingID)
 
+	if b.state == nil {
+		spec = domain.UnbindSpec{}
+		return
+	}
+
+	// In async mode the binding record is kept until the user removal has
+	// been applied to the cluster.
+	if asyncAllowed {
+		binding := serviceBinding{}
+		err = b.state.Get(ctx, bindingsCollection, bindingID, &binding)
+		switch {
+		case err == nil:
+			binding.Operation = OperationUnbind
+			binding.State = domain.InProgress
+
+			err = b.state.Put(ctx, bindingsCollection, bindingID, binding)
+			if err != nil {
+				b.logger.Errorw("Failed to update binding in state store", "error", err, "instance_id", instanceID, "binding_id", bindingID)
+				return
+			}
+
+			spec = domain.UnbindSpec{
+				IsAsync:       true,
+				OperationData: OperationUnbind,
+			}
+			return
+		case err != ErrStateNotFound:
+			return
+		}
+	}
+
+	err = b.state.Delete(ctx, bindingsCollection, bindingID)
+	if err != nil {
+		b.logger.Errorw("Failed to delete binding from state store", "error", err, "instance_id", instanceID, "binding_id", bindingID)
+		return
+	}
+
 	spec = domain.UnbindSpec{}
 	return
 }
 
-// GetBinding is currently not supported as specified by the
-// BindingsRetrievable setting in the service catalog.
+// GetBinding will return the credentials and parameters of a binding stored
+// in the state store.
 func (b Broker) GetBinding(ctx context.Context, instanceID string, bindingID string) (spec domain.GetBindingSpec, err error) {
 	b.logger.Infow("Retrieving binding", "instance_id", instanceID, "binding_id", bindingID)
 
-	err = apiresponses.NewFailureResponse(fmt.Errorf("Unknown binding ID %s", bindingID), 404, "get-binding")
+	if b.state == nil {
+		err = apiresponses.NewFailureResponse(fmt.Errorf("Unknown binding ID %s", bindingID), http.StatusNotFound, "get-binding")
+		return
+	}
+
+	binding, err := b.getBinding(ctx, instanceID, bindingID)
+	if err != nil {
+		return
+	}
+
+	// The OSB spec requires bindings still being created to be reported as
+	// not found.
+	if binding.Operation == OperationBind && binding.State == domain.InProgress {
+		err = apiresponses.ErrBindingNotFound
+		return
+	}
+
+	spec = domain.GetBindingSpec{
+		Credentials: binding.Credentials,
+	}
+
+	if binding.Parameters != "" {
+		spec.Parameters = json.RawMessage(binding.Parameters)
+	}
+
 	return
 }
 
-// LastBindingOperation should fetch the status of the last creation/deletion
-// of a database user.
-func (b Broker) LastBindingOperation(ctx context.Context, instanceID string, bindingID string, details domain.PollDetails) (domain.LastOperation, error) {
-	panic("not implemented")
+// getBinding fetches a binding record, making sure it belongs to the
+// specified instance.
+func (b Broker) getBinding(ctx context.Context, instanceID string, bindingID string) (*serviceBinding, error) {
+	binding := serviceBinding{}
+
+	err := b.state.Get(ctx, bindingsCollection, bindingID, &binding)
+	if err == ErrStateNotFound {
+		return nil, apiresponses.ErrBindingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if binding.InstanceID != instanceID {
+		return nil, apiresponses.ErrBindingNotFound
+	}
+
+	return &binding, nil
+}
+
+// bindingAuthDB returns the authentication database the user of a binding
+// was created in. Bindings without a record, or recorded before it was
+// stored, have their user in the admin database.
+func (b Broker) bindingAuthDB(ctx context.Context, bindingID string) (string, error) {
+	if b.state == nil {
+		return "admin", nil
+	}
+
+	binding := serviceBinding{}
+	err := b.state.Get(ctx, bindingsCollection, bindingID, &binding)
+	if err == ErrStateNotFound || err == nil && binding.AuthDB == "" {
+		return "admin", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return binding.AuthDB, nil
+}
+
+// LastBindingOperation will fetch the status of the last creation/deletion
+// of a database user. The operation is complete once Atlas reports that all
+// user changes have been applied to the cluster.
+func (b Broker) LastBindingOperation(ctx context.Context, instanceID string, bindingID string, details domain.PollDetails) (resp domain.LastOperation, err error) {
+	b.logger.Infow("Fetching state of last binding operation", "instance_id", instanceID, "binding_id", bindingID, "details", details)
+
+	if b.state == nil {
+		err = apiresponses.NewFailureResponse(errors.New("Async bindings are not supported in stateless mode"), http.StatusNotImplemented, "last-binding-operation")
+		return
+	}
+
+	binding, err := b.getBinding(ctx, instanceID, bindingID)
+	if err == apiresponses.ErrBindingNotFound {
+		// The record is removed once an unbind has completed.
+		if details.OperationData == OperationUnbind {
+			return domain.LastOperation{State: domain.Succeeded}, nil
+		}
+		err = apiresponses.ErrBindingDoesNotExist
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if binding.State != domain.InProgress {
+		return domain.LastOperation{State: binding.State}, nil
+	}
+
+	planContext := dynamicplans.Context{
+		"instance_id": instanceID,
+	}
+	client, gid, err := b.getClient(ctx, instanceID, details.PlanID, planContext)
+	if err != nil {
+		return
+	}
+
+	names, err := b.getClusterNamesByInstanceID(ctx, instanceID)
+	if err != nil {
+		return
+	}
+
+	// Database users are project wide, so the change has to reach every
+	// cluster of the instance.
+	for _, name := range names {
+		var status string
+		status, err = clusterChangeStatus(ctx, client, gid, name)
+		if err != nil {
+			b.logger.Errorw("Failed to get cluster change status", "error", err, "instance_id", instanceID, "binding_id", bindingID)
+			err = atlasToAPIError(err)
+			return
+		}
+
+		if status != ClusterChangeStatusApplied {
+			return domain.LastOperation{
+				State:       domain.InProgress,
+				Description: "Waiting for database user changes to be applied to the cluster",
+			}, nil
+		}
+	}
+
+	if binding.Operation == OperationUnbind {
+		err = b.state.Delete(ctx, bindingsCollection, bindingID)
+		if err != nil {
+			return
+		}
+
+		b.logger.Infow("Database user removal applied", "instance_id", instanceID, "binding_id", bindingID)
+		return domain.LastOperation{
+			State:       domain.Succeeded,
+			Description: "Database user removed from the cluster",
+		}, nil
+	}
+
+	binding.State = domain.Succeeded
+	err = b.state.Put(ctx, bindingsCollection, bindingID, binding)
+	if err != nil {
+		return
+	}
+
+	b.logger.Infow("Database user creation applied", "instance_id", instanceID, "binding_id", bindingID)
+	return domain.LastOperation{
+		State:       domain.Succeeded,
+		Description: "Database user is available on the cluster",
+	}, nil
+}
+
+// clusterConnection returns the connection details of a database user for
+// a cluster, including the private connection strings if requested.
+func (b Broker) clusterConnection(cluster *mongodbatlas.Cluster, user *mongodbatlas.DatabaseUser, private bool) ClusterConnectionDetails {
+	details := ClusterConnectionDetails{URI: cluster.SrvAddress}
+	if cluster.ConnectionStrings == nil {
+		return details
+	}
+
+	details.ConnectionString = b.connectionString(cluster.ConnectionStrings.StandardSrv, user)
+
+	if private {
+		details.PrivateURI = cluster.ConnectionStrings.Private
+		if cluster.ConnectionStrings.PrivateSrv != "" {
+			details.PrivateConnectionString = b.connectionString(cluster.ConnectionStrings.PrivateSrv, user)
+		}
+	}
+
+	return details
+}
+
+// connectionString adds the credentials and database of a user to a
+// connection string.
+func (b Broker) connectionString(raw string, user *mongodbatlas.DatabaseUser) string {
+	cs, err := url.Parse(raw)
+	if err != nil {
+		b.logger.Errorw("Failed to parse connection string", "error", err, "connString", raw)
+		return ""
+	}
+
+	cs.Path = user.DatabaseName
+
+	if len(user.Roles) > 0 {
+		cs.Path = user.Roles[0].DatabaseName
+		b.logger.Infow("Detected roles, override the name of the db to connect", "connectionString", cs)
+	}
+
+	b.logger.Infow("New User ConnectionString", "connectionString", cs)
+
+	cs.User = url.UserPassword(user.Username, user.Password)
+	return cs.String()
 }
 
 // generatePassword will generate a cryptographically secure password.
@@ -240,6 +581,12 @@ func userFromParams(bindingID string, password string, rawParams []byte, broker
             params.User.Roles = append(params.User.Roles, overrideRole)
         }
     }
+	// Plans can set the roles of bindings, for example to grant one of the
+	// plan's custom roles.
+	if len(params.User.Roles) == 0 && plan.DefaultBindingRoles != nil {
+		params.User.Roles = append(params.User.Roles, *plan.DefaultBindingRoles...)
+	}
+
 	// If no role is specified we default to read/write on any database.
 	// This is the default role when creating a user through the Atlas UI.
 	if len(params.User.Roles) == 0 {
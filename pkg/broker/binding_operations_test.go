@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBindingAuthDB(t *testing.T) {
+	ctx := context.Background()
+	b := Broker{state: NewMemoryStateStore()}
+
+	assert.NoError(t, b.state.Put(ctx, bindingsCollection, "custom", serviceBinding{ID: "custom", AuthDB: "$external"}))
+	assert.NoError(t, b.state.Put(ctx, bindingsCollection, "legacy", serviceBinding{ID: "legacy"}))
+
+	for id, expected := range map[string]string{
+		"custom":  "$external",
+		"legacy":  "admin",
+		"missing": "admin",
+	} {
+		authDB, err := b.bindingAuthDB(ctx, id)
+		assert.NoError(t, err, id)
+		assert.Equal(t, expected, authDB, id)
+	}
+}
+
+func TestUnbindChecksAllClusters(t *testing.T) {
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			_, _ = w.Write([]byte("{}"))
+		case strings.HasSuffix(r.URL.Path, "/clusters/secondary"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errorCode": "CLUSTER_NOT_FOUND"}`))
+		default:
+			_, _ = w.Write([]byte(`{"name": "primary", "stateName": "IDLE"}`))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	b := Broker{
+		logger:      zap.NewNop().Sugar(),
+		credentials: &credentials.Credentials{Projects: map[string]credentials.APIKey{"group": {}}},
+		baseURL:     server.URL + "/",
+		state:       NewMemoryStateStore(),
+		mode:        DynamicPlans,
+	}
+
+	s := serviceInstance{ID: "instance", ClusterNames: []string{"primary", "secondary"}}
+	s.Parameters = map[string]interface{}{"groupID": "group", "clusterName": "primary"}
+	assert.NoError(t, b.state.Put(ctx, instancesCollection, s.ID, s))
+
+	// The database user isn't removed while one of the clusters is missing.
+	_, err := b.Unbind(ctx, "instance", "binding", domain.UnbindDetails{}, true)
+	assert.Equal(t, apiresponses.ErrInstanceDoesNotExist, err)
+	assert.Empty(t, deleted)
+}
@@ -1,11 +1,13 @@
 package broker
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"encoding/json"
 
 	"github.com/Sectorbob/mlab-ns2/gae/ns/digest"
@@ -15,8 +17,8 @@ import (
 	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
 	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
 	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
@@ -29,33 +31,50 @@ var _ domain.ServiceBroker = new(Broker)
 type Broker struct {
 	logger      *zap.SugaredLogger
 	whitelist   Whitelist
+	quotas      *Quotas
 	credentials *credentials.Credentials
 	baseURL     string
 	mode        Mode
-	catalog     *catalog
-	client      *mongo.Client
+	state       StateStore
+
+	// currentCatalog holds the *catalog in use. It is replaced as a whole
+	// when the plan templates are reloaded.
+	currentCatalog *atomic.Value
 }
 
-// New creates a new Broker with a logger.
-func New(logger *zap.SugaredLogger, credentials *credentials.Credentials, baseURL string, whitelist Whitelist, client *mongo.Client, mode Mode) *Broker {
+// New creates a new Broker with a logger. The state store may be nil, in
+// which case the broker runs in stateless mode and quotas aren't enforced.
+func New(logger *zap.SugaredLogger, credentials *credentials.Credentials, baseURL string, whitelist Whitelist, quotas *Quotas, state StateStore, mode Mode) *Broker {
 	b := &Broker{
 		logger:      logger,
 		credentials: credentials,
 		baseURL:     baseURL,
 		whitelist:   whitelist,
-		client:      client,
+		quotas:      quotas,
+		state:       state,
 		mode:        mode,
+
+		currentCatalog: &atomic.Value{},
 	}
 
-	if err := b.buildCatalog(); err != nil {
+	c, err := b.buildCatalog()
+	if err != nil {
 		logger.Fatalw("Cannot build service catalog", "error", err)
 	}
+	b.currentCatalog.Store(c)
 
 	return b
 }
 
-func (b *Broker) parsePlan(ctx dynamicplans.Context, planID string) (dp dynamicplans.Plan, err error) {
-	sp, ok := b.catalog.plans[planID]
+// getCatalog returns the service catalog currently in use.
+func (b *Broker) getCatalog() *catalog {
+	return b.currentCatalog.Load().(*catalog)
+}
+
+// parsePlan renders the template of a plan for an instance and decodes it,
+// merging in the parameters which set overridable plan fields.
+func (b *Broker) parsePlan(instanceID string, ctx dynamicplans.Context, planID string) (dp dynamicplans.Plan, err error) {
+	sp, ok := b.getCatalog().plans[planID]
 	if !ok {
 		err = fmt.Errorf("plan ID %q not found in catalog", planID)
 		return
@@ -63,53 +82,80 @@ func (b *Broker) parsePlan(ctx dynamicplans.Context, planID string) (dp dynamicp
 
 	tpl, ok := sp.Metadata.AdditionalMetadata["template"].(dynamicplans.TemplateContainer)
 	if !ok {
-		err = errors.New("plan ID %q does not contain a valid plan template")
+		err = fmt.Errorf("plan ID %q does not contain a valid plan template", planID)
 		return
 	}
 
-	raw := new(bytes.Buffer)
-	err = tpl.Execute(raw, ctx.With("credentials", b.credentials))
+	raw, err := dynamicplans.Render(tpl.Template, ctx, dynamicplans.RenderOptions{InstanceID: instanceID, Credentials: b.credentials})
 	if err != nil {
 		return
 	}
 
-	b.logger.Infow("Parsed plan", "plan", raw.String())
+	// The rendered plan may contain credentials, use RenderPlan to inspect it.
+	b.logger.Debugw("Rendered plan", "plan_id", planID)
 
 	if err = yaml.NewDecoder(raw).Decode(&dp); err != nil {
 		return
 	}
 
-    // Attempt to merge in any other values as plan instance data
-    pb, _ := json.Marshal(ctx)
-    err = json.Unmarshal(pb, &dp)
-    if err != nil {
-        b.logger.Errorw("Error trying to merge in planContext as plan instance","err",err)
-    } else {
-        b.logger.Infow("Merged final cluster:",  "dp.Cluster", dp.Cluster)
-    }
+	// Merge the parameters setting plan fields the plan lets users
+	// override. Requests setting locked fields are rejected by
+	// checkOverrides, so locked fields only show up here in the parameters
+	// of instances provisioned before the plan locked them.
+	values, err := contextValues(ctx)
+	if err != nil {
+		return
+	}
+
+	allowed, locked := dp.Overrides(values)
+	if len(locked) > 0 {
+		b.logger.Warnw("Ignoring parameters for locked plan fields", "plan_id", planID, "fields", locked)
+	}
+
+	if len(allowed) > 0 {
+		pb, _ := json.Marshal(allowed)
+		if err = json.Unmarshal(pb, &dp); err != nil {
+			return
+		}
+		b.logger.Debugw("Merged final clusters:", "clusters", dp.AllClusters())
+	}
 
 	return dp, nil
 }
 
-func (b *Broker) getInstanceState(ctx context.Context, instanceID string) (primitive.M, error) {
-	i, err := b.GetInstance(ctx, instanceID)
+func (b *Broker) getInstance(ctx context.Context, instanceID string) (*serviceInstance, error) {
+	s := serviceInstance{}
+	if err := b.state.Get(ctx, instancesCollection, instanceID, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (b *Broker) getInstanceState(ctx context.Context, instanceID string) (map[string]interface{}, error) {
+	i, err := b.getInstance(ctx, instanceID)
 	if err != nil {
 		return nil, err
 	}
 
-	p, ok := i.Parameters.(primitive.D)
-	if !ok {
+	// The concrete type depends on the state store backend.
+	switch p := i.Parameters.(type) {
+	case primitive.D:
+		return p.Map(), nil
+	case primitive.M:
+		return p, nil
+	case map[string]interface{}:
+		return p, nil
+	default:
 		return nil, fmt.Errorf("instance metadata has the wrong type %T", i.Parameters)
 	}
-
-	return p.Map(), nil
 }
 
 func (b *Broker) getGroupIDByInstanceID(ctx context.Context, instanceID string) (string, error) {
 	s, err := b.getInstanceState(ctx, instanceID)
 	if err != nil {
 		// no metadata - not an error in our case
-		if err == mongo.ErrNoDocuments {
+		if err == ErrStateNotFound {
 			return "", nil
 		}
 		return "", err
@@ -129,7 +175,7 @@ func (b *Broker) getGroupIDByInstanceID(ctx context.Context, instanceID string)
 }
 
 func (b *Broker) getClusterNameByInstanceID(ctx context.Context, instanceID string) (string, error) {
-	if b.client == nil {
+	if b.state == nil {
 		return NormalizeClusterName(instanceID), nil
 	}
 
@@ -151,6 +197,28 @@ func (b *Broker) getClusterNameByInstanceID(ctx context.Context, instanceID stri
 	return c, nil
 }
 
+// getClusterNamesByInstanceID returns the names of all clusters of an
+// instance, the primary cluster first.
+func (b *Broker) getClusterNamesByInstanceID(ctx context.Context, instanceID string) ([]string, error) {
+	if b.state != nil {
+		s, err := b.getInstance(ctx, instanceID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(s.ClusterNames) > 0 {
+			return s.ClusterNames, nil
+		}
+	}
+
+	name, err := b.getClusterNameByInstanceID(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{name}, nil
+}
+
 func (b *Broker) getClient(ctx context.Context, instanceID string, planID string, planCtx dynamicplans.Context) (client *mongodbatlas.Client, gid string, err error) {
 	switch b.mode {
 	case BasicAuth:
@@ -165,7 +233,7 @@ func (b *Broker) getClient(ctx context.Context, instanceID string, planID string
 		panic("not implemented")
 
 	case MultiGroupAutoPlans:
-		gid, err = b.catalog.findGroupIDByPlanID(planID)
+		gid, err = b.getCatalog().findGroupIDByPlanID(planID)
 		if err != nil {
 			return nil, gid, err
 		}
@@ -183,7 +251,7 @@ func (b *Broker) getClient(ctx context.Context, instanceID string, planID string
 
 		// new instance: get groupID from params
 		dp := dynamicplans.Plan{}
-		dp, err = b.parsePlan(planCtx, planID)
+		dp, err = b.parsePlan(instanceID, planCtx, planID)
 		if err != nil {
 			return
 		}
@@ -226,18 +294,24 @@ func (b *Broker) getClient(ctx context.Context, instanceID string, planID string
 		panic("invalid broker mode")
 	}
 
-	c, ok := b.credentials.Projects[gid]
+	client, err = b.projectClient(gid)
+	return client, gid, err
+}
+
+// projectClient creates an Atlas client using the API key configured for a
+// project.
+func (b *Broker) projectClient(gid string) (*mongodbatlas.Client, error) {
+	c, ok := b.credentials.Project(gid)
 	if !ok {
-		return nil, gid, fmt.Errorf("credentials for project ID %q not found", gid)
+		return nil, fmt.Errorf("credentials for project ID %q not found", gid)
 	}
 
 	hc, err := digest.NewTransport(c.PublicKey, c.PrivateKey).Client()
 	if err != nil {
-		return nil, gid, err
+		return nil, err
 	}
 
-	client, err = mongodbatlas.New(hc, mongodbatlas.SetBaseURL(b.baseURL))
-	return client, gid, err
+	return mongodbatlas.New(hc, mongodbatlas.SetBaseURL(b.baseURL))
 }
 
 func (b *Broker) AuthMiddleware() mux.MiddlewareFunc {
@@ -257,23 +331,78 @@ func (b *Broker) GetDashboardURL(groupID, clusterName string) string {
 	return apiUrl.String() + fmt.Sprintf("#clusters/detail/%s", clusterName)
 }
 
-// TODO: do something about this!
-// atlasToAPIError converts an Atlas error to a OSB response error.
+// atlasToAPIError converts an Atlas error to a OSB response error so the
+// platform gets an actionable status code and message.
 func atlasToAPIError(err error) error {
-	// switch err {
-	// case atlas.ErrClusterNotFound:
-	// 	return apiresponses.ErrInstanceDoesNotExist
-	// case atlas.ErrClusterAlreadyExists:
-	// 	return apiresponses.ErrInstanceAlreadyExists
-	// case atlas.ErrUserAlreadyExists:
-	// 	return apiresponses.ErrBindingAlreadyExists
-	// case atlas.ErrUserNotFound:
-	// 	return apiresponses.ErrBindingDoesNotExist
-	// case atlas.ErrUnauthorized:
-	// 	return apiresponses.NewFailureResponse(err, http.StatusUnauthorized, "")
-	// }
-
-	// Fall back on returning the error again if no others match.
-	// Will result in a 500 Internal Server Error.
+	var e *mongodbatlas.ErrorResponse
+	if !errors.As(err, &e) {
+		// Fall back on returning the error again if no others match.
+		// Will result in a 500 Internal Server Error.
+		return err
+	}
+
+	switch e.ErrorCode {
+	case "DUPLICATE_CLUSTER_NAME":
+		return apiresponses.ErrInstanceAlreadyExists
+	case "CLUSTER_NOT_FOUND", "CLUSTER_ALREADY_REQUESTED_DELETION":
+		return apiresponses.ErrInstanceDoesNotExist
+	case "USER_ALREADY_EXISTS":
+		return apiresponses.ErrBindingAlreadyExists
+	case "USER_NOT_FOUND", "USERNAME_NOT_FOUND":
+		return apiresponses.ErrBindingDoesNotExist
+	}
+
+	msg := fmt.Errorf("Atlas error %s: %s", e.ErrorCode, e.Detail)
+	status := atlasStatusCode(e)
+
+	switch {
+	case isAtlasQuotaError(e.ErrorCode) || status == http.StatusPaymentRequired:
+		return apiresponses.NewFailureResponse(msg, http.StatusUnprocessableEntity, "atlas-quota-exceeded")
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		// The platform's credentials are fine, it's the broker's own API key
+		// Atlas rejected, so the broker is at fault as an upstream gateway.
+		return apiresponses.NewFailureResponse(fmt.Errorf("Atlas rejected the broker API key: %s", e.Detail), http.StatusBadGateway, "atlas-unauthorized")
+	case status == http.StatusBadRequest || isAtlasInvalidRequestError(e.ErrorCode):
+		return apiresponses.NewFailureResponse(msg, http.StatusBadRequest, "atlas-invalid-request")
+	case status == http.StatusConflict:
+		return apiresponses.NewFailureResponse(msg, http.StatusConflict, "atlas-conflict")
+	case status == http.StatusNotFound:
+		return apiresponses.NewFailureResponse(msg, http.StatusNotFound, "atlas-not-found")
+	}
+
 	return err
 }
+
+// atlasStatusCode returns the HTTP status of an Atlas error response.
+func atlasStatusCode(e *mongodbatlas.ErrorResponse) int {
+	if e.HTTPCode != 0 {
+		return e.HTTPCode
+	}
+
+	if e.Response != nil {
+		return e.Response.StatusCode
+	}
+
+	return 0
+}
+
+// isAtlasQuotaError reports whether an Atlas error code signals that a
+// project or org limit has been reached. Only known codes are listed, as
+// other codes mentioning a limit, such as RATE_LIMITED, aren't quota errors.
+func isAtlasQuotaError(code string) bool {
+	switch code {
+	case "CANNOT_EXCEED_MAX_CLUSTERS_PER_GROUP":
+		return true
+	}
+	return false
+}
+
+// isAtlasInvalidRequestError reports whether an Atlas error code signals an
+// invalid resource definition.
+func isAtlasInvalidRequestError(code string) bool {
+	switch code {
+	case "MISSING_ATTRIBUTE", "ATTRIBUTE_READ_ONLY", "ATTRIBUTE_NEGATIVE_OR_ZERO":
+		return true
+	}
+	return strings.HasPrefix(code, "INVALID_")
+}
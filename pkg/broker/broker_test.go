@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAtlasToAPIError(t *testing.T) {
+	sentinels := []struct {
+		code     string
+		httpCode int
+		expected error
+	}{
+		{"DUPLICATE_CLUSTER_NAME", http.StatusBadRequest, apiresponses.ErrInstanceAlreadyExists},
+		{"CLUSTER_NOT_FOUND", http.StatusNotFound, apiresponses.ErrInstanceDoesNotExist},
+		{"USER_ALREADY_EXISTS", http.StatusConflict, apiresponses.ErrBindingAlreadyExists},
+		{"USERNAME_NOT_FOUND", http.StatusNotFound, apiresponses.ErrBindingDoesNotExist},
+	}
+
+	for _, s := range sentinels {
+		err := atlasToAPIError(&mongodbatlas.ErrorResponse{ErrorCode: s.code, HTTPCode: s.httpCode})
+		assert.Equal(t, s.expected, err, s.code)
+	}
+
+	statuses := []struct {
+		code     string
+		httpCode int
+		expected int
+	}{
+		{"INVALID_ATTRIBUTE", http.StatusBadRequest, http.StatusBadRequest},
+		{"INVALID_ENUM_VALUE", 0, http.StatusBadRequest},
+		{"CANNOT_EXCEED_MAX_CLUSTERS_PER_GROUP", http.StatusConflict, http.StatusUnprocessableEntity},
+		{"NO_PAYMENT_INFORMATION_FOUND", http.StatusPaymentRequired, http.StatusUnprocessableEntity},
+		{"USER_CANNOT_ACCESS_ORG", http.StatusForbidden, http.StatusBadGateway},
+		{"INVALID_API_KEY", http.StatusUnauthorized, http.StatusBadGateway},
+	}
+
+	for _, s := range statuses {
+		err := atlasToAPIError(&mongodbatlas.ErrorResponse{ErrorCode: s.code, HTTPCode: s.httpCode, Detail: "detail"})
+
+		f, ok := err.(*apiresponses.FailureResponse)
+		if assert.True(t, ok, s.code) {
+			assert.Equal(t, s.expected, f.ValidatedStatusCode(nil), s.code)
+		}
+	}
+
+	// Wrapped Atlas errors are still recognized.
+	wrapped := fmt.Errorf("create cluster: %w", &mongodbatlas.ErrorResponse{ErrorCode: "CLUSTER_NOT_FOUND", HTTPCode: http.StatusNotFound})
+	assert.Equal(t, apiresponses.ErrInstanceDoesNotExist, atlasToAPIError(wrapped))
+
+	// Codes mentioning a limit aren't necessarily quota errors.
+	rateLimited := &mongodbatlas.ErrorResponse{ErrorCode: "RATE_LIMITED", HTTPCode: http.StatusTooManyRequests}
+	assert.Equal(t, rateLimited, atlasToAPIError(rateLimited))
+
+	other := errors.New("connection refused")
+	assert.Equal(t, other, atlasToAPIError(other))
+}
+
+func TestParsePlanSandbox(t *testing.T) {
+	dir := useTestTemplateDir(t)
+
+	writeTestTemplate(t, dir, "sandbox", `name: sandbox
+description: '{{ toJson .credentials }}'
+apiKey: {{ orgKey (default "" .org_id) }}
+cluster:
+  name: {{ uniqueName "cluster" }}
+  providerSettings:
+    providerName: AWS
+    instanceSizeName: M10
+    regionName: US_EAST_1
+`)
+
+	creds := &credentials.Credentials{
+		Orgs: map[string]credentials.APIKey{
+			"org": {APIKey: mongodbatlas.APIKey{ID: "key", PublicKey: "public", PrivateKey: "very-secret-key"}},
+		},
+		Broker: &credentials.BrokerAuth{Username: "broker", Password: "very-secret-password"},
+	}
+	b := New(zap.NewNop().Sugar(), creds, "", nil, nil, nil, DynamicPlans)
+
+	planID, err := b.findPlanID("sandbox")
+	assert.NoError(t, err)
+
+	// Parameters can't forge the instance ID uniqueName is derived from.
+	ctx, err := dynamicplans.NewContext("instance", json.RawMessage(`{"org_id": "org", "instance_id": "forged"}`), nil)
+	assert.NoError(t, err)
+
+	dp, err := b.parsePlan("instance", ctx, planID)
+	assert.NoError(t, err)
+
+	rendered, err := json.Marshal(dp)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(rendered), "very-secret")
+
+	assert.Equal(t, "null", dp.Description)
+	assert.Equal(t, "public", dp.APIKey.PublicKey)
+	assert.Equal(t, "cluster-5e8c03a9", dp.Cluster.Name)
+}
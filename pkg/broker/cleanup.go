@@ -0,0 +1,220 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+)
+
+// The kinds of deferred cleanup tasks.
+const (
+	cleanupDeleteProject          = "delete-project"
+	cleanupDeleteDatabaseUser     = "delete-database-user"
+	cleanupDeleteIPWhitelistEntry = "delete-ip-whitelist-entry"
+	cleanupDeleteCluster          = "delete-cluster"
+	cleanupDeleteCustomDBRole     = "delete-custom-db-role"
+	cleanupDeleteAlertConfig      = "delete-alert-configuration"
+	cleanupDeleteContainer        = "delete-container"
+	cleanupDeletePeer             = "delete-peer"
+	cleanupDeletePrivateEndpoint  = "delete-private-endpoint"
+)
+
+// The states a cleanup task can be in. Tasks are removed from the queue once
+// they succeed; tasks that exhaust their attempts are kept as dead letters.
+const (
+	cleanupStatePending = "pending"
+	cleanupStateDead    = "dead"
+)
+
+// Cleanup worker settings.
+const (
+	cleanupPollInterval = 10 * time.Second
+	cleanupInitialDelay = 30 * time.Second
+	cleanupBaseBackoff  = 30 * time.Second
+	cleanupMaxBackoff   = 30 * time.Minute
+	cleanupMaxAttempts  = 10
+)
+
+// cleanupTask is a deferred Atlas cleanup task kept in the state store so it
+// survives broker restarts.
+type cleanupTask struct {
+	ID         string `bson:"id" json:"id"`
+	Kind       string `bson:"kind" json:"kind"`
+	GroupID    string `bson:"groupID" json:"groupID"`
+	InstanceID string `bson:"instanceID,omitempty" json:"instanceID,omitempty"`
+	// Target is the username, whitelist entry, cluster name, role name or
+	// ID of the resource to delete.
+	Target string `bson:"target,omitempty" json:"target,omitempty"`
+	// AuthDB is the authentication database of a user to delete.
+	AuthDB    string    `bson:"authDB,omitempty" json:"authDB,omitempty"`
+	State     string    `bson:"state" json:"state"`
+	Attempts  int       `bson:"attempts" json:"attempts"`
+	LastError string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextRun   time.Time `bson:"nextRun" json:"nextRun"`
+	Created   time.Time `bson:"created" json:"created"`
+}
+
+// enqueueCleanup adds a task to the cleanup queue. The task will first be
+// attempted after the given delay. Failures are logged as there is nothing
+// the caller could do about them.
+func (b *Broker) enqueueCleanup(ctx context.Context, t cleanupTask, delay time.Duration) {
+	if b.state == nil {
+		b.logger.Warnw("Cannot queue cleanup task without a state store", "kind", t.Kind, "group_id", t.GroupID, "target", t.Target)
+		return
+	}
+
+	now := time.Now().UTC()
+	t.ID = uuid.New().String()
+	t.State = cleanupStatePending
+	t.Created = now
+	t.NextRun = now.Add(delay)
+
+	if err := b.state.Put(ctx, cleanupTasksCollection, t.ID, t); err != nil {
+		b.logger.Errorw("Failed to queue cleanup task", "error", err, "kind", t.Kind, "group_id", t.GroupID, "target", t.Target)
+		return
+	}
+
+	b.logger.Infow("Queued cleanup task", "task_id", t.ID, "kind", t.Kind, "group_id", t.GroupID, "target", t.Target, "next_run", t.NextRun)
+}
+
+// RunCleanupWorker processes the cleanup queue until the context is
+// cancelled. Pending tasks left over from a previous run are picked up
+// immediately.
+func (b *Broker) RunCleanupWorker(ctx context.Context) {
+	if b.state == nil {
+		b.logger.Info("Cleanup worker disabled: no state store")
+		return
+	}
+
+	b.logger.Infow("Starting cleanup worker", "poll_interval", cleanupPollInterval.String(), "max_attempts", cleanupMaxAttempts)
+
+	ticker := time.NewTicker(cleanupPollInterval)
+	defer ticker.Stop()
+
+	for {
+		b.processCleanupTasks(ctx)
+
+		select {
+		case <-ctx.Done():
+			b.logger.Info("Stopping cleanup worker")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processCleanupTasks runs all pending tasks which are due.
+func (b *Broker) processCleanupTasks(ctx context.Context) {
+	ids, err := b.state.IDs(ctx, cleanupTasksCollection)
+	if err != nil {
+		b.logger.Errorw("Failed to list cleanup tasks", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		t := cleanupTask{}
+		if err := b.state.Get(ctx, cleanupTasksCollection, id, &t); err != nil {
+			if err != ErrStateNotFound {
+				b.logger.Errorw("Failed to load cleanup task", "error", err, "task_id", id)
+			}
+			continue
+		}
+
+		if t.State != cleanupStatePending || now.Before(t.NextRun) {
+			continue
+		}
+
+		b.runCleanupTask(ctx, &t)
+	}
+}
+
+// runCleanupTask attempts a task once, rescheduling it with exponential
+// backoff on failure.
+func (b *Broker) runCleanupTask(ctx context.Context, t *cleanupTask) {
+	t.Attempts++
+
+	err := b.executeCleanupTask(ctx, t)
+	if err == nil {
+		b.logger.Infow("Cleanup task completed", "task_id", t.ID, "kind", t.Kind, "group_id", t.GroupID, "target", t.Target, "attempts", t.Attempts)
+		if err := b.state.Delete(ctx, cleanupTasksCollection, t.ID); err != nil {
+			b.logger.Errorw("Failed to remove completed cleanup task", "error", err, "task_id", t.ID)
+		}
+		return
+	}
+
+	t.LastError = err.Error()
+
+	if t.Attempts >= cleanupMaxAttempts {
+		t.State = cleanupStateDead
+		b.logger.Errorw("Cleanup task failed permanently, moved to dead letters", "error", err, "task_id", t.ID, "kind", t.Kind, "group_id", t.GroupID, "target", t.Target, "attempts", t.Attempts)
+	} else {
+		t.NextRun = time.Now().UTC().Add(cleanupBackoff(t.Attempts))
+		b.logger.Warnw("Cleanup task failed, will retry", "error", err, "task_id", t.ID, "kind", t.Kind, "group_id", t.GroupID, "target", t.Target, "attempts", t.Attempts, "next_run", t.NextRun)
+	}
+
+	if err := b.state.Put(ctx, cleanupTasksCollection, t.ID, t); err != nil {
+		b.logger.Errorw("Failed to update cleanup task", "error", err, "task_id", t.ID)
+	}
+}
+
+// executeCleanupTask performs the Atlas API call for a task. Resources which
+// no longer exist are considered cleaned up.
+func (b *Broker) executeCleanupTask(ctx context.Context, t *cleanupTask) error {
+	client, err := b.projectClient(t.GroupID)
+	if err != nil {
+		return err
+	}
+
+	var r *mongodbatlas.Response
+	switch t.Kind {
+	case cleanupDeleteProject:
+		r, err = client.Projects.Delete(ctx, t.GroupID)
+	case cleanupDeleteDatabaseUser:
+		r, err = client.DatabaseUsers.Delete(ctx, t.AuthDB, t.GroupID, t.Target)
+	case cleanupDeleteIPWhitelistEntry:
+		r, err = client.ProjectIPWhitelist.Delete(ctx, t.GroupID, t.Target)
+	case cleanupDeleteCluster:
+		r, err = client.Clusters.Delete(ctx, t.GroupID, t.Target)
+	case cleanupDeleteCustomDBRole:
+		r, err = client.CustomDBRoles.Delete(ctx, t.GroupID, t.Target)
+	case cleanupDeleteAlertConfig:
+		r, err = client.AlertConfigurations.Delete(ctx, t.GroupID, t.Target)
+	case cleanupDeleteContainer:
+		r, err = client.Containers.Delete(ctx, t.GroupID, t.Target)
+	case cleanupDeletePeer:
+		r, err = client.Peers.Delete(ctx, t.GroupID, t.Target)
+	case cleanupDeletePrivateEndpoint:
+		r, err = client.PrivateEndpoints.Delete(ctx, t.GroupID, t.Target)
+	default:
+		return fmt.Errorf("unknown cleanup task kind %q", t.Kind)
+	}
+
+	if err != nil && r != nil && r.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// cleanupBackoff returns the delay before the next attempt of a task which
+// has failed the given number of times.
+func cleanupBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return cleanupBaseBackoff
+	}
+
+	d := cleanupBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= cleanupMaxBackoff {
+			return cleanupMaxBackoff
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+)
+
+// The change statuses reported by Atlas for changes made to a project, such
+// as database users being created or removed.
+const (
+	ClusterChangeStatusPending = "PENDING"
+	ClusterChangeStatusApplied = "APPLIED"
+)
+
+// clusterStatus is the response of the cluster status endpoint.
+type clusterStatus struct {
+	ChangeStatus string `json:"changeStatus"`
+}
+
+// clusterChangeStatus fetches whether all changes made to the project have
+// been applied to a cluster.
+// GET /groups/{GROUP-ID}/clusters/{CLUSTER-NAME}/status
+func clusterChangeStatus(ctx context.Context, client *mongodbatlas.Client, groupID string, clusterName string) (string, error) {
+	path := fmt.Sprintf("groups/%s/clusters/%s/status", groupID, clusterName)
+
+	req, err := client.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	status := clusterStatus{}
+	_, err = client.Do(ctx, req, &status)
+	if err != nil {
+		return "", err
+	}
+
+	return status.ChangeStatus, nil
+}
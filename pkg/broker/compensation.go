@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"context"
+)
+
+// compensationLog records the Atlas resources created while provisioning an
+// instance, so they can be removed again if a later step fails. Entries are
+// kept as cleanup tasks so that anything which cannot be removed right away
+// can be handed to the cleanup queue.
+type compensationLog struct {
+	tasks []cleanupTask
+}
+
+// add records a resource which has been created.
+func (l *compensationLog) add(t cleanupTask) {
+	l.tasks = append(l.tasks, t)
+}
+
+// rollback removes the recorded resources in reverse order of creation.
+// Resources which cannot be removed immediately are queued for cleanup.
+func (b *Broker) rollback(ctx context.Context, op *operation, l *compensationLog) {
+	if len(l.tasks) == 0 {
+		return
+	}
+
+	_ = b.runStep(ctx, op, stepRollback, func() error {
+		for i := len(l.tasks) - 1; i >= 0; i-- {
+			t := l.tasks[i]
+
+			if err := b.executeCleanupTask(ctx, &t); err != nil {
+				b.logger.Warnw("Failed to roll back resource, queueing cleanup", "error", err, "kind", t.Kind, "group_id", t.GroupID, "target", t.Target)
+				b.enqueueCleanup(ctx, t, cleanupInitialDelay)
+				continue
+			}
+
+			b.logger.Infow("Rolled back resource", "kind", t.Kind, "group_id", t.GroupID, "target", t.Target)
+		}
+
+		return nil
+	})
+
+	l.tasks = nil
+}
@@ -2,8 +2,12 @@ package broker
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
 )
 
@@ -14,10 +18,15 @@ type contextKey string
 // ContextKeyAtlasClient is the key used to store the Atlas client in the
 // request context.
 const (
-	ContextKeyAtlasClient contextKey = "atlas-client"
-	ContextKeyGroupID     contextKey = "group-id"
+	ContextKeyAtlasClient         contextKey = "atlas-client"
+	ContextKeyGroupID             contextKey = "group-id"
+	ContextKeyOriginatingIdentity contextKey = "originating-identity"
 )
 
+// originatingIdentityHeader is the OSB header identifying the platform user
+// who triggered a request.
+const originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
 // atlasClientFromContext will retrieve an Atlas client stored inside the
 // provided context.
 func atlasClientFromContext(ctx context.Context) (*mongodbatlas.Client, error) {
@@ -37,3 +46,36 @@ func groupIDFromContext(ctx context.Context) (string, error) {
 
 	return gid, nil
 }
+
+// originatingIdentityFromContext returns the decoded originating identity of
+// the request, or an empty string if the platform did not send one.
+func originatingIdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(ContextKeyOriginatingIdentity).(string)
+	return identity
+}
+
+// OriginatingIdentityMiddleware decodes the originating identity header,
+// formatted as "<platform> <base64 encoded JSON>", and attaches it to the
+// request context as "<platform> <JSON>".
+func OriginatingIdentityMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get(originatingIdentityHeader)
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity := header
+			parts := strings.SplitN(header, " ", 2)
+			if len(parts) == 2 {
+				if value, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+					identity = parts[0] + " " + string(value)
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), ContextKeyOriginatingIdentity, identity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/Sectorbob/mlab-ns2/gae/ns/digest"
 	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
@@ -21,6 +22,44 @@ type Credentials struct {
 	Projects map[string]APIKey `json:"projects"`
 	Orgs     map[string]APIKey `json:"orgs"`
 	Broker   *BrokerAuth       `json:"broker"`
+
+	// mu guards Projects, which the broker adds the projects it creates to
+	// while serving requests. Use Project, AddProject and ProjectKeys once
+	// the credentials are in use.
+	mu sync.RWMutex
+}
+
+// Project returns the API key configured for a project.
+func (c *Credentials) Project(gid string) (APIKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key, ok := c.Projects[gid]
+	return key, ok
+}
+
+// AddProject sets the API key used for a project.
+func (c *Credentials) AddProject(gid string, key APIKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Projects == nil {
+		c.Projects = map[string]APIKey{}
+	}
+	c.Projects[gid] = key
+}
+
+// ProjectKeys returns a copy of the API keys configured for projects, by
+// project ID.
+func (c *Credentials) ProjectKeys() map[string]APIKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make(map[string]APIKey, len(c.Projects))
+	for gid, key := range c.Projects {
+		keys[gid] = key
+	}
+	return keys
 }
 
 type BrokerAuth struct {
@@ -55,7 +94,9 @@ func FromCredHub() (*Credentials, error) {
 		Orgs:     map[string]APIKey{},
 	}
 
-	for _, c := range append(services.CredHub,services.UserProvided...) {
+	hubs := append(services.CredHub,services.UserProvided...)
+	for i := range hubs {
+		c := &hubs[i]
 		for k, v := range c.Credentials.Projects {
 			result.Projects[k] = v
 		}
@@ -124,7 +165,7 @@ func (c *Credentials) FlattenOrgs(baseURL string) error {
 			if pp.OrgID != k {
 				continue
 			}
-			c.Projects[pp.ID] = v
+			c.AddProject(pp.ID, v)
 		}
 	}
 
@@ -0,0 +1,41 @@
+package credentials
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectKeysConcurrentAccess(t *testing.T) {
+	c := &Credentials{Orgs: map[string]APIKey{}}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		gid := fmt.Sprintf("project-%d", i)
+
+		go func() {
+			defer wg.Done()
+			c.AddProject(gid, APIKey{DisplayName: gid})
+		}()
+		go func() {
+			defer wg.Done()
+			_, _ = c.Project(gid)
+			_ = c.ProjectKeys()
+		}()
+	}
+	wg.Wait()
+
+	keys := c.ProjectKeys()
+	assert.Len(t, keys, 10)
+
+	key, ok := c.Project("project-3")
+	assert.True(t, ok)
+	assert.Equal(t, "project-3", key.DisplayName)
+
+	// The copy doesn't change with the credentials.
+	c.AddProject("other", APIKey{})
+	assert.Len(t, keys, 10)
+}
@@ -1,7 +1,36 @@
 package dynamicplans
 
+import "encoding/json"
+
 type Context map[string]interface{}
 
+// NewContext builds the context a plan is rendered with for an OSB request:
+// the request parameters, the platform context merged over them, and the
+// instance ID, which neither can override.
+func NewContext(instanceID string, rawParameters json.RawMessage, rawContext json.RawMessage) (Context, error) {
+	c := Context{}
+
+	if len(rawParameters) > 0 {
+		if err := json.Unmarshal(rawParameters, &c); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rawContext) > 0 {
+		if err := json.Unmarshal(rawContext, &c); err != nil {
+			return nil, err
+		}
+	}
+
+	// A parameters document of null leaves no context to add to.
+	if c == nil {
+		c = Context{}
+	}
+
+	c["instance_id"] = instanceID
+	return c, nil
+}
+
 func (c Context) With(key string, value interface{}) Context {
 	newCtx := Context{}
 	for k, v := range c {
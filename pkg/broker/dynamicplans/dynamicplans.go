@@ -1,68 +1,258 @@
 package dynamicplans
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 
-	"github.com/Masterminds/sprig/v3"
+	"github.com/goccy/go-yaml"
 )
 
+// TemplateDirEnv is the environment variable pointing at the plan template
+// directory.
+const TemplateDirEnv = "ATLAS_BROKER_TEMPLATEDIR"
+
+// DirFromEnv returns the plan template directory, if one is configured.
+func DirFromEnv() (string, bool) {
+	return os.LookupEnv(TemplateDirEnv)
+}
+
+// FromEnv parses the plan templates of the source configured in the
+// environment. It returns nil if no source is configured.
 func FromEnv() ([]*template.Template, error) {
-	planPath, found := os.LookupEnv("ATLAS_BROKER_TEMPLATEDIR")
-	if !found {
-		return nil, nil
+	src, err := SourceFromEnv()
+	if err != nil || src == nil {
+		return nil, err
 	}
 
-	files, err := ioutil.ReadDir(planPath)
+	return FromSource(src)
+}
+
+// FromDir parses all plan templates (*.tpl) in a directory, along with the
+// partials (_*.tpl) they can include or extend.
+func FromDir(planPath string) ([]*template.Template, error) {
+	return FromSource(DirSource{Path: planPath})
+}
+
+// FromSource parses the plan templates of a source, along with the partials
+// they can include or extend. Plans are returned ordered by file name.
+func FromSource(src Source) ([]*template.Template, error) {
+	files, err := src.Files()
 	if err != nil {
 		return nil, err
 	}
 
 	templates := []*template.Template{}
+	for _, f := range ParseFiles(files) {
+		if f.Err != nil {
+			return nil, f.Err
+		}
+
+		if !f.Partial {
+			templates = append(templates, f.Template)
+		}
+	}
+
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no templates found in %s", src)
+	}
+
+	return templates, nil
+}
+
+// ParsedFile is a template file of a source parsed by ParseFiles.
+type ParsedFile struct {
+	Name     string
+	Text     string
+	Partial  bool
+	Template *template.Template
+	Err      error
+}
+
+// ParseFiles parses the template files (*.tpl) of a source into one set,
+// ordered by file name. Unlike FromSource it doesn't stop at the first file
+// which fails to parse, its error is recorded with the file instead.
+func ParseFiles(files map[string]string) []ParsedFile {
+	names := []string{}
+	for name := range files {
+		if filepath.Ext(name) == ".tpl" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	set := NewSet()
+	parsed := make([]ParsedFile, 0, len(names))
+	for _, name := range names {
+		t, err := Parse(set, name, files[name])
+		parsed = append(parsed, ParsedFile{
+			Name:     name,
+			Text:     files[name],
+			Partial:  strings.HasPrefix(name, "_"),
+			Template: t,
+			Err:      err,
+		})
+	}
+
+	return parsed
+}
+
+// TemplateFiles lists the plan template files (*.tpl) in a directory.
+// Partials are not plans and left out.
+func TemplateFiles(planPath string) ([]string, error) {
+	return listTemplates(planPath, false)
+}
+
+// PartialFiles lists the partial template files (_*.tpl) in a directory.
+func PartialFiles(planPath string) ([]string, error) {
+	return listTemplates(planPath, true)
+}
+
+func listTemplates(planPath string, partials bool) ([]string, error) {
+	files, err := ioutil.ReadDir(planPath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
 	for _, f := range files {
 		if f.IsDir() {
 			continue
 		}
 
-		ext := filepath.Ext(f.Name())
-		if ext != ".tpl" {
+		if filepath.Ext(f.Name()) != ".tpl" {
 			continue
 		}
 
-		text, err := ioutil.ReadFile(filepath.Join(planPath, f.Name()))
-		if err != nil {
-			return nil, err
+		if strings.HasPrefix(f.Name(), "_") != partials {
+			continue
 		}
 
-		// trim .tpl
-		basename := strings.TrimSuffix(f.Name(), ext)
-		// also trim .yml/.yaml/.json (if any)
-		basename = strings.TrimSuffix(basename, filepath.Ext(basename))
-
-		t, err := template.
-			New(basename).
-			Funcs(sprig.TxtFuncMap()).
-			Funcs(template.FuncMap{
-				"default": dfault,
-			}).
-			Parse(string(text))
-
-		if err != nil {
-			return nil, err
-		}
-		templates = append(templates, t)
+		paths = append(paths, filepath.Join(planPath, f.Name()))
 	}
 
-	if len(templates) == 0 {
-		return nil, errors.New("no templates found")
+	return paths, nil
+}
+
+// TemplateName returns the name a template file is known by: its file name
+// without the leading underscore of partials and without extensions.
+func TemplateName(path string) string {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+
+	// trim .tpl
+	basename := strings.TrimSuffix(name, ext)
+	// also trim .yml/.yaml/.json (if any)
+	basename = strings.TrimSuffix(basename, filepath.Ext(basename))
+
+	return strings.TrimPrefix(basename, "_")
+}
+
+// NewSet returns an empty template set. The plan templates and partials of
+// a directory are parsed into one set, so they can include and extend each
+// other by name. Unsafe template functions are only available if enabled in
+// the environment.
+func NewSet() *template.Template {
+	return template.New("").Funcs(Funcs(UnsafeFuncsEnabled()))
+}
+
+// Parse parses the text of a plan template or partial into a set. The
+// template is named after the file it was read from.
+func Parse(set *template.Template, path string, text string) (*template.Template, error) {
+	name := TemplateName(path)
+	if set.Lookup(name) != nil {
+		return nil, fmt.Errorf("template %q is defined more than once", name)
 	}
 
-	return templates, nil
+	return set.New(name).Parse(text)
+}
+
+// maxExtendsDepth limits how many plans can extend each other in a chain,
+// which also stops cycles.
+const maxExtendsDepth = 10
+
+// Render executes a plan template. A plan with an `extends` key names
+// another template of its set, which is rendered with the same data. The
+// plan is then deep-merged over its parent: maps are merged key by key,
+// while lists and any other values replace the parent's.
+//
+// The template is rendered in a copy of its set, with the broker functions
+// bound to the options.
+func Render(t *template.Template, data interface{}, opts RenderOptions) (*bytes.Buffer, error) {
+	set, err := t.Clone()
+	if err != nil {
+		return nil, err
+	}
+	set.Funcs(boundFuncs(set, opts))
+
+	return render(set, data, 0)
+}
+
+func render(t *template.Template, data interface{}, depth int) (*bytes.Buffer, error) {
+	raw := new(bytes.Buffer)
+	if err := t.Execute(raw, data); err != nil {
+		return nil, err
+	}
+
+	// Plans which can't be decoded are left for the caller to report.
+	child := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw.Bytes(), &child); err != nil {
+		return raw, nil
+	}
+
+	name, ok := child["extends"].(string)
+	if !ok {
+		return raw, nil
+	}
+
+	if depth >= maxExtendsDepth {
+		return nil, fmt.Errorf("template %q: more than %d levels of extends", t.Name(), maxExtendsDepth)
+	}
+
+	parent := t.Lookup(name)
+	if parent == nil {
+		return nil, fmt.Errorf("template %q extends unknown template %q", t.Name(), name)
+	}
+
+	parentRaw, err := render(parent, data, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	base := map[string]interface{}{}
+	if err := yaml.Unmarshal(parentRaw.Bytes(), &base); err != nil {
+		return nil, fmt.Errorf("cannot decode template %q extended by %q: %v", name, t.Name(), err)
+	}
+
+	delete(child, "extends")
+	merged, err := yaml.Marshal(merge(base, child))
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(merged), nil
+}
+
+// merge deep-merges the values of a child plan over those of its parent.
+func merge(parent map[string]interface{}, child map[string]interface{}) map[string]interface{} {
+	for k, v := range child {
+		pm, pok := parent[k].(map[string]interface{})
+		cm, cok := v.(map[string]interface{})
+		if pok && cok {
+			parent[k] = merge(pm, cm)
+			continue
+		}
+
+		parent[k] = v
+	}
+
+	return parent
 }
 
 // custom default function to fix Sprig's stupidity with booleans
@@ -0,0 +1,90 @@
+package dynamicplans
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromDirPartialsAndExtends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"_common.tpl": `{{ define "project" -}}
+project:
+  name: {{ .instance_name }}
+  orgId: org
+{{- end }}`,
+		"base.yml.tpl": `name: base
+description: Base plan
+{{ include "project" . }}
+cluster:
+  name: {{ .instance_name }}
+  providerSettings:
+    providerName: AWS
+    instanceSizeName: M10
+ipWhitelists:
+- ipAddress: 10.0.0.1
+`,
+		"child.yml.tpl": `extends: base
+name: child
+cluster:
+  providerSettings:
+    instanceSizeName: M30
+ipWhitelists:
+- ipAddress: 10.0.0.2
+`,
+	}
+	for name, text := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644))
+	}
+
+	templates, err := FromDir(dir)
+	assert.NoError(t, err)
+	if !assert.Len(t, templates, 2) {
+		return
+	}
+
+	byName := map[string]Plan{}
+	for _, tpl := range templates {
+		raw, err := Render(tpl, Context{"instance_name": "instance"}, RenderOptions{})
+		assert.NoError(t, err)
+
+		p := Plan{}
+		assert.NoError(t, yaml.NewDecoder(raw).Decode(&p))
+		byName[tpl.Name()] = p
+	}
+
+	child := byName["child"]
+	assert.Equal(t, "child", child.Name)
+	assert.Equal(t, "Base plan", child.Description)
+	assert.Equal(t, "instance", child.Project.Name)
+	assert.Equal(t, "instance", child.Cluster.Name)
+	assert.Equal(t, "AWS", child.Cluster.ProviderSettings.ProviderName)
+	assert.Equal(t, "M30", child.Cluster.ProviderSettings.InstanceSizeName)
+	if assert.Len(t, child.IPWhitelists, 1) {
+		assert.Equal(t, "10.0.0.2", child.IPWhitelists[0].IPAddress)
+	}
+
+	assert.Equal(t, "M10", byName["base"].Cluster.ProviderSettings.InstanceSizeName)
+}
+
+func TestRenderExtendsCycle(t *testing.T) {
+	set := NewSet()
+	_, err := Parse(set, "a.yml.tpl", "extends: b\n")
+	assert.NoError(t, err)
+	b, err := Parse(set, "b.yml.tpl", "extends: a\n")
+	assert.NoError(t, err)
+
+	_, err = Render(b, Context{}, RenderOptions{})
+	assert.Error(t, err)
+
+	_, err = Parse(set, "_a.tpl", "")
+	assert.EqualError(t, err, `template "a" is defined more than once`)
+}
@@ -0,0 +1,171 @@
+package dynamicplans
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+)
+
+// UnsafeFuncsEnv is the environment variable which, set to "true", makes the
+// unsafe template functions available to plan templates.
+const UnsafeFuncsEnv = "ATLAS_BROKER_TEMPLATE_UNSAFE_FUNCS"
+
+// safeFuncs are the Sprig functions available to plan templates. Only
+// functions whose result depends on nothing but their arguments are listed,
+// and functions added to Sprig later are left out until they are added here.
+var safeFuncs = []string{
+	// strings
+	"abbrev", "abbrevboth", "trunc", "trim", "upper", "lower", "title", "untitle",
+	"substr", "repeat", "trimall", "trimAll", "trimSuffix", "trimPrefix", "nospace",
+	"initials", "swapcase", "snakecase", "camelcase", "kebabcase", "wrap", "wrapWith",
+	"contains", "hasPrefix", "hasSuffix", "quote", "squote", "cat", "indent", "nindent",
+	"replace", "plural", "toString", "split", "splitList", "splitn", "toStrings",
+	"join", "sortAlpha",
+
+	// numbers
+	"atoi", "int64", "int", "float64", "toDecimal", "seq", "until", "untilStep",
+	"add1", "add", "sub", "div", "mod", "mul", "biggest", "max", "min", "ceil",
+	"floor", "round", "duration", "durationRound",
+
+	// defaults, JSON and types
+	"empty", "coalesce", "compact", "mustCompact", "ternary", "deepCopy",
+	"mustDeepCopy", "toJson", "toPrettyJson", "toRawJson", "mustToJson",
+	"mustToPrettyJson", "mustToRawJson", "typeOf", "typeIs", "typeIsLike", "kindOf",
+	"kindIs", "deepEqual", "fail",
+
+	// lists and dicts
+	"tuple", "list", "dict", "get", "set", "unset", "hasKey", "pluck", "keys", "pick",
+	"omit", "merge", "mergeOverwrite", "mustMerge", "mustMergeOverwrite", "values",
+	"append", "push", "mustAppend", "mustPush", "prepend", "mustPrepend", "first",
+	"mustFirst", "rest", "mustRest", "last", "mustLast", "initial", "mustInitial",
+	"reverse", "mustReverse", "uniq", "mustUniq", "without", "mustWithout", "has",
+	"mustHas", "slice", "mustSlice", "concat",
+
+	// encoding, hashes, paths, URLs, regular expressions and versions
+	"b64enc", "b64dec", "b32enc", "b32dec", "sha1sum", "sha256sum", "adler32sum",
+	"base", "dir", "clean", "ext", "isAbs", "urlParse", "urlJoin",
+	"regexMatch", "mustRegexMatch", "regexFindAll", "mustRegexFindAll", "regexFind",
+	"mustRegexFind", "regexReplaceAll", "mustRegexReplaceAll", "regexReplaceAllLiteral",
+	"mustRegexReplaceAllLiteral", "regexSplit", "mustRegexSplit",
+	"semver", "semverCompare",
+}
+
+// unsafeFuncs are the Sprig functions only available to plan templates if
+// enabled with UnsafeFuncsEnv. They read the broker's environment or the
+// network, depend on the time or return a different result every time
+// they're called, which breaks plans that are re-rendered on every update.
+var unsafeFuncs = []string{
+	// environment and network
+	"env", "expandenv", "getHostByName",
+
+	// time
+	"now", "date", "date_in_zone", "date_modify", "dateInZone", "dateModify",
+	"must_date_modify", "mustDateModify", "htmlDate", "htmlDateInZone", "ago",
+	"toDate", "mustToDate", "unixEpoch",
+
+	// randomness and cryptography
+	"randAlphaNum", "randAlpha", "randAscii", "randNumeric", "uuidv4", "shuffle",
+	"htpasswd", "genPrivateKey", "derivePassword", "buildCustomCert", "genCA",
+	"genSelfSignedCert", "genSignedCert", "encryptAES", "decryptAES",
+}
+
+// UnsafeFuncsEnabled reports whether the unsafe template functions are
+// enabled in the environment.
+func UnsafeFuncsEnabled() bool {
+	return os.Getenv(UnsafeFuncsEnv) == "true"
+}
+
+// RenderOptions holds what the broker functions of a template are bound to
+// when a plan is rendered. They are kept out of the template data, so
+// templates can't read the credentials or forge the instance ID.
+type RenderOptions struct {
+	// InstanceID is the ID of the instance the plan is rendered for, empty
+	// when rendering the catalog.
+	InstanceID string
+
+	// Credentials are the API keys orgKey looks keys up in.
+	Credentials *credentials.Credentials
+}
+
+// Funcs returns the functions available to plan templates: the safe Sprig
+// functions, the unsafe ones too if unsafe is set, and the broker's own. The
+// broker functions fail until Render binds them.
+func Funcs(unsafe bool) template.FuncMap {
+	names := safeFuncs
+	if unsafe {
+		names = append(append([]string{}, safeFuncs...), unsafeFuncs...)
+	}
+
+	sprigFuncs := sprig.TxtFuncMap()
+	funcs := template.FuncMap{}
+	for _, name := range names {
+		if f, ok := sprigFuncs[name]; ok {
+			funcs[name] = f
+		}
+	}
+
+	funcs["default"] = dfault
+	for name, f := range boundFuncs(nil, RenderOptions{}) {
+		funcs[name] = f
+	}
+
+	return funcs
+}
+
+// boundFuncs returns the broker functions, bound to a template set and the
+// options a plan is rendered with. include renders another template of the
+// set and returns its text. orgKey returns a reference to the API key of an
+// org, its ID and public key as JSON, but never the private key. uniqueName
+// returns a name made unique to the instance, which stays the same whenever
+// the instance's plan is rendered.
+func boundFuncs(set *template.Template, opts RenderOptions) template.FuncMap {
+	return template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			if set == nil {
+				return "", fmt.Errorf("include %q: templates can only be included while rendering a plan", name)
+			}
+
+			buf := new(bytes.Buffer)
+			err := set.ExecuteTemplate(buf, name, data)
+			return buf.String(), err
+		},
+		"orgKey": func(orgID string) (string, error) {
+			return orgKey(opts.Credentials, orgID)
+		},
+		"uniqueName": func(prefix string) string {
+			sum := sha256.Sum256([]byte(opts.InstanceID))
+			return prefix + "-" + hex.EncodeToString(sum[:])[:8]
+		},
+	}
+}
+
+func orgKey(creds *credentials.Credentials, orgID string) (string, error) {
+	if orgID == "" {
+		return "null", nil
+	}
+
+	var key credentials.APIKey
+	ok := false
+	if creds != nil {
+		key, ok = creds.Orgs[orgID]
+	}
+
+	if !ok {
+		return "", fmt.Errorf("no API key configured for org ID %q", orgID)
+	}
+
+	ref, err := json.Marshal(mongodbatlas.APIKey{
+		ID:        key.ID,
+		PublicKey: key.PublicKey,
+		Desc:      key.DisplayName,
+	})
+	return string(ref), err
+}
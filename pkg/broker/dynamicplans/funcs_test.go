@@ -0,0 +1,51 @@
+package dynamicplans
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuncs(t *testing.T) {
+	creds := &credentials.Credentials{Orgs: map[string]credentials.APIKey{
+		"org": {APIKey: mongodbatlas.APIKey{ID: "key", PublicKey: "public", PrivateKey: "secret"}},
+	}}
+	data := Context{"org_id": "org"}
+	opts := RenderOptions{InstanceID: "instance", Credentials: creds}
+
+	set := NewSet()
+	plan, err := Parse(set, "plan.yml.tpl", `{{ orgKey .org_id }} {{ uniqueName "orders" }} {{ uniqueName "orders" }}`)
+	assert.NoError(t, err)
+
+	raw, err := Render(plan, data, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"key","publicKey":"public"} orders-5e8c03a9 orders-5e8c03a9`, raw.String())
+
+	_, err = Render(plan, data.With("org_id", "other"), opts)
+	assert.Error(t, err)
+
+	_, err = Parse(NewSet(), "env.yml.tpl", `{{ env "BROKER_APIKEYS" }}`)
+	assert.Error(t, err)
+
+	// Sprig functions which aren't listed are never available.
+	_, err = Parse(NewSet(), "hello.yml.tpl", `{{ hello }}`)
+	assert.Error(t, err)
+
+	sprigFuncs := sprig.TxtFuncMap()
+	for _, name := range append(append([]string{}, safeFuncs...), unsafeFuncs...) {
+		assert.Contains(t, sprigFuncs, name)
+	}
+
+	os.Setenv(UnsafeFuncsEnv, "true")
+	defer os.Unsetenv(UnsafeFuncsEnv)
+
+	_, err = Parse(NewSet(), "env.yml.tpl", `{{ env "BROKER_APIKEYS" }}`)
+	assert.NoError(t, err)
+
+	_, err = Parse(NewSet(), "hello.yml.tpl", `{{ hello }}`)
+	assert.Error(t, err)
+}
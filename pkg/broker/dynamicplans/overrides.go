@@ -0,0 +1,111 @@
+package dynamicplans
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// LockedFieldsError is returned for parameters which try to set plan fields
+// the plan doesn't let users override.
+type LockedFieldsError struct {
+	Fields []string
+}
+
+func (e *LockedFieldsError) Error() string {
+	return "parameters cannot override locked plan fields: " + strings.Join(e.Fields, ", ")
+}
+
+// planFields holds the JSON names of the fields of a plan.
+var planFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Plan{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// IsPlanField reports whether name is the JSON name of a plan field.
+func IsPlanField(name string) bool {
+	return planFields[name]
+}
+
+// Overrides splits the values of a context which set plan fields into the
+// ones the plan lets users override and the paths of the locked fields they
+// try to set. Values are expected in the shape produced by decoding JSON.
+// Maps are descended into, so a user allowed to set
+// `cluster.providerSettings.instanceSizeName` can pass it as part of a
+// `cluster` map; lists and other values are overridden as a whole.
+func (p Plan) Overrides(values map[string]interface{}) (map[string]interface{}, []string) {
+	allowed := map[string]interface{}{}
+	locked := []string{}
+
+	for k, v := range values {
+		if !planFields[k] {
+			continue
+		}
+
+		if a, ok := p.override(k, v, &locked); ok {
+			allowed[k] = a
+		}
+	}
+
+	sort.Strings(locked)
+	return allowed, locked
+}
+
+// override returns the part of a value at path that may be overridden and
+// adds the locked paths within it to locked.
+func (p Plan) override(path string, value interface{}, locked *[]string) (interface{}, bool) {
+	if p.isOverridable(path) {
+		return value, true
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok || !p.hasOverridableChild(path) {
+		*locked = append(*locked, path)
+		return nil, false
+	}
+
+	allowed := map[string]interface{}{}
+	for k, v := range m {
+		if a, ok := p.override(path+"."+k, v, locked); ok {
+			allowed[k] = a
+		}
+	}
+
+	return allowed, len(allowed) > 0
+}
+
+// isOverridable reports whether the field at path, or one of the fields
+// containing it, is listed in the plan's overridable fields.
+func (p Plan) isOverridable(path string) bool {
+	for _, o := range p.Overridable {
+		if path == o || strings.HasPrefix(path, o+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Plan) hasOverridableChild(path string) bool {
+	for _, o := range p.Overridable {
+		if strings.HasPrefix(o, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOverrides returns a *LockedFieldsError if the values set any plan
+// field the plan doesn't let users override.
+func (p Plan) CheckOverrides(values map[string]interface{}) error {
+	if _, locked := p.Overrides(values); len(locked) > 0 {
+		return &LockedFieldsError{Fields: locked}
+	}
+	return nil
+}
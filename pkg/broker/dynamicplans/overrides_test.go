@@ -0,0 +1,38 @@
+package dynamicplans
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanOverrides(t *testing.T) {
+	p := Plan{Overridable: []string{"cluster.providerSettings.instanceSizeName", "cluster.labels"}}
+
+	allowed, locked := p.Overrides(map[string]interface{}{
+		"instance_name": "ignored",
+		"cluster": map[string]interface{}{
+			"diskSizeGB": 100.0,
+			"labels":     []interface{}{},
+			"providerSettings": map[string]interface{}{
+				"instanceSizeName": "M30",
+				"regionName":       "EU_WEST_1",
+			},
+		},
+		"ipWhitelists": []interface{}{map[string]interface{}{"cidrBlock": "0.0.0.0/0"}},
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"cluster": map[string]interface{}{
+			"labels": []interface{}{},
+			"providerSettings": map[string]interface{}{
+				"instanceSizeName": "M30",
+			},
+		},
+	}, allowed)
+	assert.Equal(t, []string{"cluster.diskSizeGB", "cluster.providerSettings.regionName", "ipWhitelists"}, locked)
+
+	err := p.CheckOverrides(map[string]interface{}{"cluster": "M30"})
+	assert.Equal(t, &LockedFieldsError{Fields: []string{"cluster"}}, err)
+	assert.NoError(t, p.CheckOverrides(map[string]interface{}{"org_id": "org"}))
+}
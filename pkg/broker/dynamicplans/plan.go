@@ -1,29 +1,149 @@
 package dynamicplans
 
-import "github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+import (
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/pivotal-cf/brokerapi/domain"
+)
 
 const(
     BROKER_SETTING_OVERRIDE_BIND_DB      = "overrideBindDB"
     BROKER_SETTING_OVERRIDE_BIND_DB_ROLE = "overrideBindDBRole"
+    // BROKER_SETTING_PRIVATE_CONNECTION_STRINGS set to "true" adds the
+    // private connection strings of the clusters to bindings.
+    BROKER_SETTING_PRIVATE_CONNECTION_STRINGS = "privateConnectionStrings"
 )
 
 // Plan represents a set of MongoDB Atlas resources
 type Plan struct {
-	Version             string                             `json:"version,omitempty"`
-	Name                string                             `json:"name,omitempty"`
-	Description         string                             `json:"description,omitempty"`
-	Free                *bool                              `json:"free,omitempty"`
-	APIKey              *mongodbatlas.APIKey               `json:"apiKey,omitempty"`
-	Project             *mongodbatlas.Project              `json:"project,omitempty"`
-	Cluster             *mongodbatlas.Cluster              `json:"cluster,omitempty"`
-	DatabaseUsers       []*mongodbatlas.DatabaseUser       `json:"databaseUsers,omitempty"`
-	IPWhitelists        []*mongodbatlas.ProjectIPWhitelist `json:"ipWhitelists,omitempty"`
-	DefaultBindingRoles *[]mongodbatlas.Role               `json:"defaultBindingRoles"`
-	Bindings            []*Binding                         `json:"bindings,omitempty"` // READ ONLY! Populated by bind()
+	Version             string                                          `json:"version,omitempty"`
+	Name                string                                          `json:"name,omitempty"`
+	Description         string                                          `json:"description,omitempty"`
+	Free                *bool                                           `json:"free,omitempty"`
+	Service             *Service                                        `json:"service,omitempty"`
+	APIKey              *mongodbatlas.APIKey                            `json:"apiKey,omitempty"`
+	Project             *mongodbatlas.Project                           `json:"project,omitempty"`
+	ProjectSettings     *ProjectSettings                                `json:"projectSettings,omitempty"`
+	MaintenanceWindow   *mongodbatlas.MaintenanceWindow                 `json:"maintenanceWindow,omitempty"`
+	Teams               []*mongodbatlas.ProjectTeam                     `json:"teams,omitempty"`
+	Cluster             *mongodbatlas.Cluster                           `json:"cluster,omitempty"`
+	Clusters            []*mongodbatlas.Cluster                         `json:"clusters,omitempty"`
+	DatabaseUsers       []*mongodbatlas.DatabaseUser                    `json:"databaseUsers,omitempty"`
+	IPWhitelists        []*mongodbatlas.ProjectIPWhitelist              `json:"ipWhitelists,omitempty"`
+	CustomDBRoles       []*mongodbatlas.CustomDBRole                    `json:"customDBRoles,omitempty"`
+	AlertConfigurations []*mongodbatlas.AlertConfiguration              `json:"alertConfigurations,omitempty"`
+	NetworkContainers   []*mongodbatlas.Container                       `json:"networkContainers,omitempty"`
+	NetworkPeering      []*mongodbatlas.Peer                            `json:"networkPeering,omitempty"`
+	PrivateEndpoints    []*mongodbatlas.PrivateEndpointConnection       `json:"privateEndpoints,omitempty"`
+	BackupPolicy        *mongodbatlas.CloudProviderSnapshotBackupPolicy `json:"backupPolicy,omitempty"`
+	DefaultBindingRoles *[]mongodbatlas.Role                            `json:"defaultBindingRoles"`
+	Bindings            []*Binding                                      `json:"bindings,omitempty"` // READ ONLY! Populated by bind()
+	Parameters          *PlanParameters                                 `json:"parameters,omitempty"`
+	Overridable         []string                                        `json:"overridable,omitempty"`
+	Quota               *Quota                                          `json:"quota,omitempty"`
 
     Settings            map[string]string                 `json:"settings,omitempty"`
 }
 
+// AllClusters returns the clusters of a plan: the cluster given as
+// `cluster`, if any, followed by those in `clusters`. The first one is the
+// instance's primary cluster.
+func (p Plan) AllClusters() []*mongodbatlas.Cluster {
+	clusters := []*mongodbatlas.Cluster{}
+	if p.Cluster != nil {
+		clusters = append(clusters, p.Cluster)
+	}
+
+	for _, c := range p.Clusters {
+		if c != nil {
+			clusters = append(clusters, c)
+		}
+	}
+
+	return clusters
+}
+
+// PeerContainer returns the index of the network container of the plan a
+// peering connection without a containerId belongs to: the first container
+// for the same provider. It returns -1 if there is none.
+func (p Plan) PeerContainer(peer *mongodbatlas.Peer) int {
+	for i, c := range p.NetworkContainers {
+		if peer.ProviderName == "" || c.ProviderName == peer.ProviderName {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// redacted replaces secrets in rendered plans.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the plan with secrets, such as the API private
+// key and database user passwords, replaced so it can be shown to plan
+// authors.
+func (p Plan) Redacted() Plan {
+	if p.APIKey != nil {
+		k := *p.APIKey
+		if k.PrivateKey != "" {
+			k.PrivateKey = redacted
+		}
+		p.APIKey = &k
+	}
+
+	users := make([]*mongodbatlas.DatabaseUser, 0, len(p.DatabaseUsers))
+	for _, u := range p.DatabaseUsers {
+		if u == nil {
+			continue
+		}
+
+		c := *u
+		if c.Password != "" {
+			c.Password = redacted
+		}
+		users = append(users, &c)
+	}
+	p.DatabaseUsers = users
+
+	return p
+}
+
+// Service is the catalog service a plan is offered under. Plans declaring
+// the same service are grouped into it.
+type Service struct {
+	ID             string                  `json:"id,omitempty"`
+	Name           string                  `json:"name,omitempty"`
+	Description    string                  `json:"description,omitempty"`
+	Metadata       *domain.ServiceMetadata `json:"metadata,omitempty"`
+	Tags           []string                `json:"tags,omitempty"`
+	Bindable       *bool                   `json:"bindable,omitempty"`
+	PlanUpdateable *bool                   `json:"plan_updateable,omitempty"`
+}
+
+// ProjectSettings are the settings of an Atlas project, which the Atlas
+// client doesn't cover yet.
+type ProjectSettings struct {
+	IsDataExplorerEnabled       *bool `json:"isDataExplorerEnabled,omitempty"`
+	IsPerformanceAdvisorEnabled *bool `json:"isPerformanceAdvisorEnabled,omitempty"`
+}
+
+// Quota limits the number of instances which can be provisioned. Limits of
+// zero are not enforced.
+type Quota struct {
+	// MaxInstances limits the number of instances in total.
+	MaxInstances int `json:"maxInstances,omitempty"`
+
+	// MaxInstancesPerOrg limits the number of instances in an Atlas org.
+	MaxInstancesPerOrg int `json:"maxInstancesPerOrg,omitempty"`
+
+	// MaxInstancesPerNamespace limits the number of instances in a
+	// Kubernetes namespace or Cloud Foundry space.
+	MaxInstancesPerNamespace int `json:"maxInstancesPerNamespace,omitempty"`
+
+	// MaxInstancesPerCFOrg limits the number of instances in a Cloud
+	// Foundry org.
+	MaxInstancesPerCFOrg int `json:"maxInstancesPerCFOrg,omitempty"`
+}
+
 // Binding info
 type Binding struct {
 }
@@ -0,0 +1,483 @@
+package dynamicplans
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a JSON Schema document.
+type Schema map[string]interface{}
+
+// PlanParameters holds the JSON Schemas for the parameters accepted when
+// creating or updating an instance of a plan and when binding to it.
+type PlanParameters struct {
+	Create Schema `json:"create,omitempty"`
+	Update Schema `json:"update,omitempty"`
+	Bind   Schema `json:"bind,omitempty"`
+}
+
+// ValidationError lists every violation found while validating a value
+// against a schema.
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid parameters: " + strings.Join(e.Violations, "; ")
+}
+
+// Normalize converts a schema decoded from YAML into the shape produced by
+// decoding JSON: string keyed maps, and float64 numbers.
+func (s Schema) Normalize() Schema {
+	if s == nil {
+		return nil
+	}
+
+	n, _ := normalize(map[string]interface{}(s)).(map[string]interface{})
+	return Schema(n)
+}
+
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case Schema:
+		return normalize(map[string]interface{}(t))
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = normalize(e)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[fmt.Sprint(k)] = normalize(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = normalize(e)
+		}
+		return out
+	}
+
+	if f, ok := toNumber(v); ok {
+		return f
+	}
+	return v
+}
+
+// schemaKeywords are the keywords Validate supports, along with the
+// annotations which don't constrain values. How the subschemas below a
+// keyword are found is given by its kind.
+var schemaKeywords = map[string]subschemas{
+	"type": noSubschemas, "enum": noSubschemas, "const": noSubschemas,
+	"required": noSubschemas, "minItems": noSubschemas, "maxItems": noSubschemas,
+	"minLength": noSubschemas, "maxLength": noSubschemas, "pattern": noSubschemas,
+	"minimum": noSubschemas, "maximum": noSubschemas,
+	"exclusiveMinimum": noSubschemas, "exclusiveMaximum": noSubschemas,
+
+	"properties":           schemaMap,
+	"additionalProperties": singleSchema,
+	"items":                singleSchema,
+	"not":                  singleSchema,
+	"allOf":                schemaList,
+	"anyOf":                schemaList,
+	"oneOf":                schemaList,
+
+	"$schema": noSubschemas, "$id": noSubschemas, "$comment": noSubschemas,
+	"title": noSubschemas, "description": noSubschemas, "default": noSubschemas,
+	"examples": noSubschemas, "readOnly": noSubschemas, "writeOnly": noSubschemas,
+}
+
+type subschemas int
+
+const (
+	noSubschemas subschemas = iota
+	singleSchema
+	schemaList
+	schemaMap
+)
+
+// UnsupportedKeywordsError lists the schema keywords Validate doesn't
+// support, by their path in the schema.
+type UnsupportedKeywordsError struct {
+	Keywords []string
+}
+
+func (e *UnsupportedKeywordsError) Error() string {
+	return "unsupported JSON Schema keywords: " + strings.Join(e.Keywords, ", ")
+}
+
+// Check returns an *UnsupportedKeywordsError if the schema uses keywords
+// Validate doesn't support. Such schemas are rejected rather than having the
+// constraints of those keywords silently accept any value.
+func (s Schema) Check() error {
+	unsupported := checkKeywords(map[string]interface{}(s.Normalize()), "")
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	sort.Strings(unsupported)
+	return &UnsupportedKeywordsError{Keywords: unsupported}
+}
+
+func checkKeywords(schema map[string]interface{}, path string) []string {
+	var unsupported []string
+	for k, v := range schema {
+		at := k
+		if path != "" {
+			at = path + "." + k
+		}
+
+		kind, ok := schemaKeywords[k]
+		if !ok {
+			unsupported = append(unsupported, at)
+			continue
+		}
+
+		switch kind {
+		case singleSchema:
+			switch sub := v.(type) {
+			case map[string]interface{}:
+				unsupported = append(unsupported, checkKeywords(sub, at)...)
+			case bool:
+				// Only additionalProperties can be turned on or off.
+				if k != "additionalProperties" {
+					unsupported = append(unsupported, at)
+				}
+			default:
+				// Lists of item schemas validate tuples, which aren't
+				// supported.
+				unsupported = append(unsupported, at)
+			}
+		case schemaList:
+			list, _ := v.([]interface{})
+			for i, e := range list {
+				if sub, ok := e.(map[string]interface{}); ok {
+					unsupported = append(unsupported, checkKeywords(sub, fmt.Sprintf("%s[%d]", at, i))...)
+				}
+			}
+		case schemaMap:
+			props, _ := v.(map[string]interface{})
+			for name, e := range props {
+				if sub, ok := e.(map[string]interface{}); ok {
+					unsupported = append(unsupported, checkKeywords(sub, at+"."+name)...)
+				}
+			}
+		}
+	}
+	return unsupported
+}
+
+// Check returns an *UnsupportedKeywordsError listing the unsupported
+// keywords of all the parameter schemas.
+func (p *PlanParameters) Check() error {
+	if p == nil {
+		return nil
+	}
+
+	unsupported := []string{}
+	for name, s := range map[string]Schema{"create": p.Create, "update": p.Update, "bind": p.Bind} {
+		if err, ok := s.Check().(*UnsupportedKeywordsError); ok {
+			for _, k := range err.Keywords {
+				unsupported = append(unsupported, name+"."+k)
+			}
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	sort.Strings(unsupported)
+	return &UnsupportedKeywordsError{Keywords: unsupported}
+}
+
+// Validate checks a value decoded from JSON against the schema. Only the
+// validation keywords commonly used for service parameters are supported:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and not. Schemas
+// using other keywords are rejected by Check when plans are loaded.
+func (s Schema) Validate(value interface{}) error {
+	if len(s) == 0 {
+		return nil
+	}
+
+	violations := validate(map[string]interface{}(s.Normalize()), normalize(value), "")
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Violations: violations}
+}
+
+func validate(schema map[string]interface{}, value interface{}, path string) []string {
+	var v []string
+	at := path
+	if at == "" {
+		at = "(root)"
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		return append(v, fmt.Sprintf("%s: expected %s, got %s", at, typeNames(t), typeOf(value)))
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v = append(v, fmt.Sprintf("%s: must be one of %v", at, enum))
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		v = append(v, fmt.Sprintf("%s: must be %v", at, c))
+	}
+
+	switch t := value.(type) {
+	case map[string]interface{}:
+		v = append(v, validateObject(schema, t, path)...)
+	case []interface{}:
+		v = append(v, validateArray(schema, t, path)...)
+	case string:
+		v = append(v, validateString(schema, t, at)...)
+	case float64:
+		v = append(v, validateNumber(schema, t, at)...)
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if m, ok := sub.(map[string]interface{}); ok {
+				v = append(v, validate(m, value, path)...)
+			}
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && countMatches(anyOf, value, path) == 0 {
+		v = append(v, fmt.Sprintf("%s: must match at least one of the allowed schemas", at))
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok && countMatches(oneOf, value, path) != 1 {
+		v = append(v, fmt.Sprintf("%s: must match exactly one of the allowed schemas", at))
+	}
+
+	if not, ok := schema["not"].(map[string]interface{}); ok && len(validate(not, value, path)) == 0 {
+		v = append(v, fmt.Sprintf("%s: must not match the disallowed schema", at))
+	}
+
+	return v
+}
+
+func validateObject(schema map[string]interface{}, obj map[string]interface{}, path string) []string {
+	var v []string
+	at := path
+	if at == "" {
+		at = "(root)"
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				v = append(v, fmt.Sprintf("%s: missing required property %q", at, name))
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+
+	// Iterate in a stable order so errors are reproducible.
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		child := k
+		if path != "" {
+			child = path + "." + k
+		}
+
+		if p, ok := props[k].(map[string]interface{}); ok {
+			v = append(v, validate(p, obj[k], child)...)
+			continue
+		}
+
+		switch ap := schema["additionalProperties"].(type) {
+		case bool:
+			if !ap {
+				v = append(v, fmt.Sprintf("%s: unknown property %q", at, k))
+			}
+		case map[string]interface{}:
+			v = append(v, validate(ap, obj[k], child)...)
+		}
+	}
+
+	return v
+}
+
+func validateArray(schema map[string]interface{}, arr []interface{}, path string) []string {
+	var v []string
+	at := path
+	if at == "" {
+		at = "(root)"
+	}
+
+	if min, ok := toNumber(schema["minItems"]); ok && float64(len(arr)) < min {
+		v = append(v, fmt.Sprintf("%s: must have at least %v items", at, min))
+	}
+	if max, ok := toNumber(schema["maxItems"]); ok && float64(len(arr)) > max {
+		v = append(v, fmt.Sprintf("%s: must have at most %v items", at, max))
+	}
+
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, e := range arr {
+			v = append(v, validate(items, e, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return v
+}
+
+func validateString(schema map[string]interface{}, s string, at string) []string {
+	var v []string
+	n := float64(len([]rune(s)))
+
+	if min, ok := toNumber(schema["minLength"]); ok && n < min {
+		v = append(v, fmt.Sprintf("%s: must be at least %v characters long", at, min))
+	}
+	if max, ok := toNumber(schema["maxLength"]); ok && n > max {
+		v = append(v, fmt.Sprintf("%s: must be at most %v characters long", at, max))
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v = append(v, fmt.Sprintf("%s: invalid pattern %q in schema", at, pattern))
+		} else if !re.MatchString(s) {
+			v = append(v, fmt.Sprintf("%s: must match pattern %q", at, pattern))
+		}
+	}
+
+	return v
+}
+
+func validateNumber(schema map[string]interface{}, f float64, at string) []string {
+	var v []string
+
+	if min, ok := toNumber(schema["minimum"]); ok && f < min {
+		v = append(v, fmt.Sprintf("%s: must be >= %v", at, min))
+	}
+	if max, ok := toNumber(schema["maximum"]); ok && f > max {
+		v = append(v, fmt.Sprintf("%s: must be <= %v", at, max))
+	}
+	if min, ok := toNumber(schema["exclusiveMinimum"]); ok && f <= min {
+		v = append(v, fmt.Sprintf("%s: must be > %v", at, min))
+	}
+	if max, ok := toNumber(schema["exclusiveMaximum"]); ok && f >= max {
+		v = append(v, fmt.Sprintf("%s: must be < %v", at, max))
+	}
+
+	return v
+}
+
+func countMatches(schemas []interface{}, value interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		if m, ok := sub.(map[string]interface{}); ok && len(validate(m, value, path)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch tt := t.(type) {
+	case string:
+		return isType(tt, value)
+	case []interface{}:
+		for _, e := range tt {
+			if s, ok := e.(string); ok && isType(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return typeOf(value) == name
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func typeNames(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, e := range list {
+			names = append(names, fmt.Sprint(e))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,112 @@
+package dynamicplans
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	// Schemas are decoded from YAML, so numbers may be integers.
+	schema := Schema{
+		"type":                 "object",
+		"additionalProperties": false,
+		"required":             []interface{}{"instance_size"},
+		"properties": map[string]interface{}{
+			"instance_size": map[string]interface{}{
+				"type": "string",
+				"enum": []interface{}{"M10", "M20", "M30"},
+			},
+			"backups": map[string]interface{}{
+				"type": "boolean",
+			},
+			"disk_size": map[string]interface{}{
+				"type":    "integer",
+				"minimum": uint64(10),
+				"maximum": uint64(4096),
+			},
+			"region": map[string]interface{}{
+				"type":    "string",
+				"pattern": "^[A-Z0-9_]+$",
+			},
+			"tags": map[string]interface{}{
+				"type":     "array",
+				"maxItems": 2,
+				"items":    map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+
+	tests := []struct {
+		params     string
+		violations int
+	}{
+		{`{"instance_size": "M10"}`, 0},
+		{`{"instance_size": "M20", "backups": true, "disk_size": 40, "region": "US_EAST_1", "tags": ["a"]}`, 0},
+		{`{}`, 1},
+		{`{"instance_size": "M1000"}`, 1},
+		{`{"instance_size": "M10", "backups": "yes"}`, 1},
+		{`{"instance_size": "M10", "disk_size": 5.5}`, 1},
+		{`{"instance_size": "M10", "disk_size": 5000}`, 1},
+		{`{"instance_size": "M10", "region": "us-east-1"}`, 1},
+		{`{"instance_size": "M10", "tags": ["a", "b", 3]}`, 2},
+		{`{"instance_size": "M10", "unknown": 1}`, 1},
+		{`[]`, 1},
+	}
+
+	for _, test := range tests {
+		var params interface{}
+		assert.NoError(t, json.Unmarshal([]byte(test.params), &params))
+
+		err := schema.Validate(params)
+		if test.violations == 0 {
+			assert.NoError(t, err, test.params)
+			continue
+		}
+
+		if assert.IsType(t, &ValidationError{}, err, test.params) {
+			assert.Len(t, err.(*ValidationError).Violations, test.violations, test.params)
+		}
+	}
+
+	assert.NoError(t, Schema(nil).Validate(map[string]interface{}{"anything": 1}))
+}
+
+func TestSchemaCheck(t *testing.T) {
+	assert.NoError(t, Schema(nil).Check())
+	assert.NoError(t, Schema{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string", "description": "Name", "maxLength": 10},
+		},
+		"anyOf": []interface{}{map[string]interface{}{"required": []interface{}{"name"}}},
+	}.Check())
+
+	// Keywords Validate would ignore are reported, however deep they are.
+	err := Schema{
+		"definitions": map[string]interface{}{},
+		"properties": map[string]interface{}{
+			"email": map[string]interface{}{"type": "string", "format": "email"},
+			"tags":  map[string]interface{}{"type": "array", "uniqueItems": true},
+			"ref":   map[string]interface{}{"$ref": "#/definitions/ref"},
+		},
+		"oneOf": []interface{}{map[string]interface{}{"multipleOf": 2}},
+		"items": []interface{}{map[string]interface{}{"type": "string"}},
+	}.Check()
+	if assert.IsType(t, &UnsupportedKeywordsError{}, err) {
+		assert.Equal(t, []string{
+			"definitions",
+			"items",
+			"oneOf[0].multipleOf",
+			"properties.email.format",
+			"properties.ref.$ref",
+			"properties.tags.uniqueItems",
+		}, err.(*UnsupportedKeywordsError).Keywords)
+	}
+
+	params := &PlanParameters{Bind: Schema{"patternProperties": map[string]interface{}{}}}
+	assert.EqualError(t, params.Check(), "unsupported JSON Schema keywords: bind.patternProperties")
+}
@@ -0,0 +1,325 @@
+package dynamicplans
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Environment variables configuring where plan templates are loaded from.
+// Only one source can be configured.
+const (
+	TemplateConfigMapEnv = "ATLAS_BROKER_TEMPLATE_CONFIGMAP"
+	TemplateURLsEnv      = "ATLAS_BROKER_TEMPLATE_URLS"
+	TemplateGitEnv       = "ATLAS_BROKER_TEMPLATE_GIT"
+	TemplateGitSubDirEnv = "ATLAS_BROKER_TEMPLATE_GIT_SUBDIR"
+	TemplateGitPullEnv   = "ATLAS_BROKER_TEMPLATE_GIT_PULL"
+)
+
+// serviceAccountNamespace holds the namespace of the pod the broker runs in.
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Source is a place plan templates are loaded from.
+type Source interface {
+	// Files returns the text of the template files of the source, partials
+	// included, by file name. Files other than *.tpl are ignored.
+	Files() (map[string]string, error)
+
+	// String describes the source for logs.
+	String() string
+}
+
+// DirSource loads templates from a directory.
+type DirSource struct {
+	Path string
+}
+
+func (s DirSource) Files() (map[string]string, error) {
+	partials, err := PartialFiles(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	plans, err := TemplateFiles(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	for _, f := range append(partials, plans...) {
+		text, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(f)] = string(text)
+	}
+
+	return files, nil
+}
+
+func (s DirSource) String() string {
+	return "directory " + s.Path
+}
+
+// ConfigMapSource loads templates from the data of a Kubernetes ConfigMap,
+// one template per key.
+type ConfigMapSource struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+func (s ConfigMapSource) Files() (map[string]string, error) {
+	cm, err := s.Client.CoreV1().ConfigMaps(s.Namespace).Get(s.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.Data, nil
+}
+
+func (s ConfigMapSource) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", s.Namespace, s.Name)
+}
+
+// httpClient is used by HTTPSource unless it's given a client. Templates are
+// loaded while serving catalog and provision requests, so a server which
+// doesn't respond must not hold them up indefinitely.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// HTTPSource loads templates from HTTP(S) URLs, one template per URL, named
+// after the last element of the URL path. Responses are cached by their
+// ETag, so unchanged templates aren't downloaded again on every reload.
+type HTTPSource struct {
+	URLs   []string
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedTemplate
+}
+
+type cachedTemplate struct {
+	etag string
+	text string
+}
+
+func (s *HTTPSource) Files() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cache == nil {
+		s.cache = map[string]cachedTemplate{}
+	}
+
+	files := map[string]string{}
+	for _, u := range s.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Base(parsed.Path)
+		if path.Ext(name) != ".tpl" {
+			return nil, fmt.Errorf("template URL %q does not name a .tpl file", u)
+		}
+
+		text, err := s.fetch(u)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = text
+	}
+
+	return files, nil
+}
+
+func (s *HTTPSource) fetch(u string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	cached, ok := s.cache[u]
+	if ok {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = httpClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		return cached.text, nil
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("cannot fetch template %s: %s", u, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		s.cache[u] = cachedTemplate{etag: etag, text: string(body)}
+	} else {
+		delete(s.cache, u)
+	}
+
+	return string(body), nil
+}
+
+func (s *HTTPSource) String() string {
+	return "URLs " + strings.Join(s.URLs, ", ")
+}
+
+// GitSource loads templates from a directory of a git checkout, such as one
+// kept up to date by a git-sync sidecar. With Pull set, the checkout is
+// fast-forwarded with `git pull` before every load.
+type GitSource struct {
+	Path   string
+	SubDir string
+	Pull   bool
+}
+
+func (s GitSource) Files() (map[string]string, error) {
+	if s.Pull {
+		out, err := exec.Command("git", "-C", s.Path, "pull", "--ff-only").CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("git pull in %s failed: %v: %s", s.Path, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return DirSource{Path: filepath.Join(s.Path, s.SubDir)}.Files()
+}
+
+func (s GitSource) String() string {
+	return "git checkout " + filepath.Join(s.Path, s.SubDir)
+}
+
+// The source configured in the environment is kept between calls to
+// SourceFromEnv, so cached templates survive catalog reloads.
+var (
+	envSourceMu  sync.Mutex
+	envSourceKey string
+	envSource    Source
+)
+
+// SourceFromEnv returns the template source configured in the environment,
+// or nil if there is none.
+func SourceFromEnv() (Source, error) {
+	vars := []string{TemplateDirEnv, TemplateConfigMapEnv, TemplateURLsEnv, TemplateGitEnv, TemplateGitSubDirEnv, TemplateGitPullEnv}
+	values := make([]string, len(vars))
+	for i, v := range vars {
+		values[i] = os.Getenv(v)
+	}
+	key := strings.Join(values, "\x00")
+
+	envSourceMu.Lock()
+	defer envSourceMu.Unlock()
+
+	if envSource != nil && envSourceKey == key {
+		return envSource, nil
+	}
+
+	src, err := newSourceFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	envSource, envSourceKey = src, key
+	return src, nil
+}
+
+func newSourceFromEnv() (Source, error) {
+	sources := []Source{}
+
+	if dir, ok := DirFromEnv(); ok {
+		sources = append(sources, DirSource{Path: dir})
+	}
+
+	if name := os.Getenv(TemplateConfigMapEnv); name != "" {
+		src, err := configMapSource(name)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+
+	if urls := os.Getenv(TemplateURLsEnv); urls != "" {
+		src := &HTTPSource{}
+		for _, u := range strings.Split(urls, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				src.URLs = append(src.URLs, u)
+			}
+		}
+		sources = append(sources, src)
+	}
+
+	if checkout := os.Getenv(TemplateGitEnv); checkout != "" {
+		sources = append(sources, GitSource{
+			Path:   checkout,
+			SubDir: os.Getenv(TemplateGitSubDirEnv),
+			Pull:   os.Getenv(TemplateGitPullEnv) == "true",
+		})
+	}
+
+	switch len(sources) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sources[0], nil
+	default:
+		return nil, errors.New("more than one plan template source is configured")
+	}
+}
+
+// configMapSource returns the source for a ConfigMap given as "name" or
+// "namespace/name", using the broker's in-cluster service account. Without
+// a namespace the ConfigMap is looked up in the broker's own namespace.
+func configMapSource(name string) (Source, error) {
+	namespace := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine the namespace of ConfigMap %q: %v", name, err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return ConfigMapSource{Client: client, Namespace: namespace, Name: name}, nil
+}
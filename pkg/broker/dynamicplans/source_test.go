@@ -0,0 +1,79 @@
+package dynamicplans
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testPlan = `name: {{ include "name" . }}
+description: Test plan
+`
+
+func TestConfigMapSource(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "broker", Name: "plans"},
+		Data: map[string]string{
+			"_name.tpl":     "test",
+			"basic.yml.tpl": testPlan,
+			"README.md":     "Not a template",
+		},
+	})
+
+	templates, err := FromSource(ConfigMapSource{Client: client, Namespace: "broker", Name: "plans"})
+	assert.NoError(t, err)
+	if assert.Len(t, templates, 1) {
+		assert.Equal(t, "basic", templates[0].Name())
+	}
+
+	_, err = FromSource(ConfigMapSource{Client: client, Namespace: "broker", Name: "missing"})
+	assert.Error(t, err)
+}
+
+func TestHTTPSourceETag(t *testing.T) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(testPlan))
+	}))
+	defer server.Close()
+
+	src := &HTTPSource{URLs: []string{server.URL + "/plans/basic.yml.tpl"}}
+
+	for i := 0; i < 2; i++ {
+		files, err := src.Files()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"basic.yml.tpl": testPlan}, files)
+	}
+	assert.Equal(t, 1, downloads)
+
+	_, err := (&HTTPSource{URLs: []string{server.URL + "/plans"}}).Files()
+	assert.Error(t, err)
+}
+
+func TestHTTPSourceTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = &http.Client{Timeout: 10 * time.Millisecond}
+
+	_, err := (&HTTPSource{URLs: []string{server.URL + "/plans/basic.yml.tpl"}}).Files()
+	assert.Error(t, err)
+}
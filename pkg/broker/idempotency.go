@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// provisionExisting answers a provision request for an instance which is
+// already recorded in the state store. A repeat of the original request gets
+// the original result, anything else is a conflict. So is a repeat of a
+// request which failed, along with the recorded error.
+func (b *Broker) provisionExisting(ctx context.Context, s *serviceInstance, details domain.ProvisionDetails) (domain.ProvisionedServiceSpec, error) {
+	if s.ServiceID != details.ServiceID || s.PlanID != details.PlanID || !sameParameters(s.RawParameters, details.RawParameters) {
+		b.logger.Warnw("Conflicting provision request for existing instance", "instance_id", s.ID, "plan_id", details.PlanID)
+		return domain.ProvisionedServiceSpec{}, apiresponses.ErrInstanceAlreadyExists
+	}
+
+	op, err := b.getOperation(ctx, s.OperationID)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+
+	if op != nil && op.State == domain.InProgress {
+		b.logger.Infow("Provision already in progress", "instance_id", s.ID, "operation_id", op.ID)
+		return domain.ProvisionedServiceSpec{
+			IsAsync:       true,
+			OperationData: op.ID,
+			DashboardURL:  s.DashboardURL,
+		}, nil
+	}
+
+	// The failed instance has to be deprovisioned before its ID can be
+	// provisioned again, reporting it as provisioned would hide the failure.
+	if op != nil && op.State == domain.Failed {
+		b.logger.Warnw("Provision request for instance which failed to provision", "instance_id", s.ID, "operation_id", op.ID, "error", op.Error)
+		return domain.ProvisionedServiceSpec{}, apiresponses.NewFailureResponse(fmt.Errorf("instance %s failed to provision: %s", s.ID, op.Error), http.StatusConflict, "provision-failed")
+	}
+
+	b.logger.Infow("Instance already provisioned", "instance_id", s.ID)
+	return domain.ProvisionedServiceSpec{
+		AlreadyExists: true,
+		DashboardURL:  s.DashboardURL,
+	}, nil
+}
+
+// bindExisting answers a bind request for a binding which is already
+// recorded in the state store. A repeat of the original request gets the
+// original credentials, anything else is a conflict.
+func (b *Broker) bindExisting(binding *serviceBinding, instanceID string, details domain.BindDetails) (domain.Binding, error) {
+	if binding.InstanceID != instanceID ||
+		(binding.PlanID != "" && binding.PlanID != details.PlanID) ||
+		!sameParameters(binding.Parameters, details.RawParameters) {
+		b.logger.Warnw("Conflicting bind request for existing binding", "instance_id", instanceID, "binding_id", binding.ID)
+		return domain.Binding{}, apiresponses.ErrBindingAlreadyExists
+	}
+
+	if binding.State == domain.InProgress {
+		if binding.Operation == OperationUnbind {
+			return domain.Binding{}, apiresponses.ErrConcurrentInstanceAccess
+		}
+
+		return domain.Binding{
+			IsAsync:       true,
+			OperationData: OperationBind,
+		}, nil
+	}
+
+	b.logger.Infow("Binding already exists", "instance_id", instanceID, "binding_id", binding.ID)
+	return domain.Binding{
+		AlreadyExists: true,
+		Credentials:   binding.Credentials,
+	}, nil
+}
+
+// sameParameters reports whether the stored parameters of a request are
+// equivalent to new ones, ignoring formatting and key order.
+func sameParameters(stored string, raw json.RawMessage) bool {
+	if stored == "" {
+		stored = "{}"
+	}
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+
+	var a, b interface{}
+	if err := json.Unmarshal([]byte(stored), &a); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(a, b)
+}
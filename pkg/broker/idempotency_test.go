@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestSameParameters(t *testing.T) {
+	assert.True(t, sameParameters("", nil))
+	assert.True(t, sameParameters("{}", nil))
+	assert.True(t, sameParameters(`{"a":1,"b":"x"}`, json.RawMessage(`{ "b": "x", "a": 1 }`)))
+	assert.False(t, sameParameters(`{"a":1}`, json.RawMessage(`{"a":2}`)))
+	assert.False(t, sameParameters("", json.RawMessage(`{"a":1}`)))
+}
+
+func TestProvisionExisting(t *testing.T) {
+	ctx := context.Background()
+	b := &Broker{
+		logger: zap.NewNop().Sugar(),
+		state:  NewMemoryStateStore(),
+	}
+
+	op, err := b.startOperation(ctx, "instance", OperationProvision)
+	assert.NoError(t, err)
+
+	s := &serviceInstance{
+		ID: "instance",
+		GetInstanceDetailsSpec: domain.GetInstanceDetailsSpec{
+			ServiceID: "service",
+			PlanID:    "plan",
+		},
+		RawParameters: `{"a":1}`,
+		OperationID:   op.ID,
+	}
+
+	details := domain.ProvisionDetails{
+		ServiceID:     "service",
+		PlanID:        "plan",
+		RawParameters: json.RawMessage(`{"a":1}`),
+	}
+
+	spec, err := b.provisionExisting(ctx, s, details)
+	assert.NoError(t, err)
+	assert.True(t, spec.IsAsync)
+	assert.Equal(t, op.ID, spec.OperationData)
+
+	op.succeed()
+	b.saveOperation(ctx, op)
+
+	spec, err = b.provisionExisting(ctx, s, details)
+	assert.NoError(t, err)
+	assert.True(t, spec.AlreadyExists)
+	assert.False(t, spec.IsAsync)
+
+	details.PlanID = "other"
+	_, err = b.provisionExisting(ctx, s, details)
+	assert.Equal(t, apiresponses.ErrInstanceAlreadyExists, err)
+
+	// A repeat of a failed provision gets the failure.
+	details.PlanID = "plan"
+	op.fail(errors.New("cluster creation failed"))
+	b.saveOperation(ctx, op)
+
+	_, err = b.provisionExisting(ctx, s, details)
+	f, ok := err.(*apiresponses.FailureResponse)
+	if assert.True(t, ok) {
+		assert.Equal(t, http.StatusConflict, f.ValidatedStatusCode(nil))
+		assert.Contains(t, f.Error(), "cluster creation failed")
+	}
+}
+
+func TestProvisionRetryAfterSynchronousFailure(t *testing.T) {
+	dir := useTestTemplateDir(t)
+	writeTestTemplate(t, dir, "basic", `name: basic
+apiKey: {{ orgKey "org" }}
+project:
+  name: {{ uniqueName "project" }}
+  orgId: org
+cluster:
+  name: {{ uniqueName "cluster" }}
+  providerSettings:
+    providerName: AWS
+    instanceSizeName: M10
+    regionName: US_EAST_1
+`)
+
+	created := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			created++
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"errorCode": "CANNOT_EXCEED_MAX_CLUSTERS_PER_GROUP", "detail": "limit reached"}`))
+	}))
+	defer server.Close()
+
+	creds := &credentials.Credentials{
+		Orgs: map[string]credentials.APIKey{"org": {APIKey: mongodbatlas.APIKey{ID: "key"}}},
+	}
+	b := New(zap.NewNop().Sugar(), creds, server.URL+"/", nil, nil, NewMemoryStateStore(), DynamicPlans)
+
+	planID, err := b.findPlanID("basic")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	details := domain.ProvisionDetails{ServiceID: "service", PlanID: planID}
+
+	// The platform gets the failure from the request itself, so the
+	// instance isn't kept and a retry is provisioned afresh rather than
+	// being told about the earlier failure.
+	for i := 1; i <= 2; i++ {
+		_, err = b.Provision(ctx, "instance", details, true)
+		f, ok := err.(*apiresponses.FailureResponse)
+		if assert.True(t, ok) {
+			assert.Equal(t, http.StatusUnprocessableEntity, f.ValidatedStatusCode(nil))
+		}
+		assert.Equal(t, i, created)
+
+		_, err = b.getInstance(ctx, "instance")
+		assert.Equal(t, ErrStateNotFound, err)
+	}
+}
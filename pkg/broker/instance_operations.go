@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-    "time"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
 	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
@@ -31,36 +32,49 @@ const (
 func (b Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (spec domain.ProvisionedServiceSpec, err error) {
 	b.logger.Infow("Provisioning instance", "instance_id", instanceID, "details", details)
 
-	planContext := dynamicplans.Context{
-		"instance_id": instanceID,
-	}
-	if len(details.RawParameters) > 0 {
-		err = json.Unmarshal(details.RawParameters, &planContext)
-		if err != nil {
+	// Platforms retry provision requests which time out, so an instance we
+	// already know about is not necessarily a conflict.
+	if b.state != nil {
+		var existing *serviceInstance
+		existing, err = b.getInstance(ctx, instanceID)
+		switch err {
+		case nil:
+			return b.provisionExisting(ctx, existing, details)
+		case ErrStateNotFound:
+			err = nil
+		default:
 			return
 		}
 	}
 
-	if len(details.RawContext) > 0 {
-		err = json.Unmarshal(details.RawContext, &planContext)
-		if err != nil {
-			return
-		}
+	err = b.checkMaintenanceInfo(details.PlanID, details.MaintenanceInfo)
+	if err != nil {
+		return
 	}
 
-	client, gid, err := b.getClient(ctx, instanceID, details.PlanID, planContext)
+	err = b.validateParameters(details.PlanID, schemaCreate, details.RawParameters)
 	if err != nil {
 		return
 	}
 
-	if b.mode == DynamicPlans && gid == "" {
-		//p := &mongodbatlas.Project{}
-        p, err2 := b.createResources(ctx, client, details.PlanID, planContext)
-		if err2 != nil {
-			return
-		}
+	planContext, err := dynamicplans.NewContext(instanceID, details.RawParameters, details.RawContext)
+	if err != nil {
+		return
+	}
 
-		gid = p.ID
+	err = b.checkOverrides(instanceID, details.PlanID, planContext, details.RawParameters)
+	if err != nil {
+		return
+	}
+
+	owner, err := b.checkQuotas(ctx, instanceID, details.PlanID, planContext, details.RawContext)
+	if err != nil {
+		return
+	}
+
+	client, gid, err := b.getClient(ctx, instanceID, details.PlanID, planContext)
+	if err != nil {
+		return
 	}
 
 	// Async needs to be supported for provisioning to work.
@@ -69,65 +83,146 @@ func (b Broker) Provision(ctx context.Context, instanceID string, details domain
 		return
 	}
 
-	// Construct a cluster definition from the instance ID, service, plan, and params.
-	b.logger.Infow("Creating cluster", "instance_name", planContext["instance_name"])
-	// TODO - add this context info about k8s/namespace or pcf space into labels
-	cluster, err := b.clusterFromParams(instanceID, details.ServiceID, details.PlanID, planContext)
+	op, err := b.startOperation(ctx, instanceID, OperationProvision)
 	if err != nil {
-		b.logger.Errorw("Couldn't create cluster from the passed parameters", "error", err, "instance_id", instanceID, "details", details)
 		return
 	}
+	defer b.failOperationOnError(ctx, op, &err)
 
 	s := serviceInstance{
 		ID: instanceID,
 		GetInstanceDetailsSpec: domain.GetInstanceDetailsSpec{
-			PlanID:       details.PlanID,
-			ServiceID:    details.ServiceID,
-			DashboardURL: b.GetDashboardURL(gid, cluster.Name),
+			PlanID:    details.PlanID,
+			ServiceID: details.ServiceID,
 			Parameters: bson.M{
-				"groupID":     gid,
-				"clusterName": cluster.Name,
+				"groupID": gid,
 			},
 		},
-	}
-
-	if b.client != nil {
-		col := b.client.Database("atlas-broker").Collection("instances")
-		_, err = col.InsertOne(ctx, s)
+		RawParameters: string(details.RawParameters),
+		OperationID:   operationData(op, OperationProvision),
+		Created:       time.Now().UTC(),
+		PlanVersion:   b.planVersion(details.PlanID),
+		OrgID:         owner.OrgID,
+		Namespace:     owner.Namespace,
+		CFOrg:         owner.CFOrg,
+	}
+
+	// Record the instance before any Atlas resources are created so that a
+	// retried request finds it.
+	if b.state != nil {
+		err = b.state.Put(ctx, instancesCollection, instanceID, s)
 		if err != nil {
 			return
 		}
 
+		// A failure returned to the platform from this request leaves no
+		// instance behind, so a retry provisions it afresh. Only failures
+		// found later by LastOperation are kept and reported to retries.
 		defer func() {
 			if err != nil {
-                _, err = col.DeleteOne(ctx, s)
-                if err != nil {
-                    panic("Error during provision, broker maintenance: " + err.Error())
-                }
+				if derr := b.state.Delete(ctx, instancesCollection, instanceID); derr != nil {
+					b.logger.Errorw("Failed to clean up instance from state store", "error", derr, "instance_id", instanceID)
+				}
 			}
 		}()
 	}
 
-	// Create a new Atlas cluster from the generated definition
-	resultingCluster, _, err := client.Clusters.Create(ctx, gid, cluster)
+	// Anything created below is removed again if provisioning fails.
+	comp := &compensationLog{}
+	defer func() {
+		if err != nil {
+			b.rollback(ctx, op, comp)
+		}
+	}()
+
+	if b.mode == DynamicPlans && gid == "" {
+		var p *mongodbatlas.Project
+		p, err = b.createResources(ctx, op, comp, client, &s, details.PlanID, planContext)
+		if err != nil {
+			b.logger.Errorw("Failed to create plan resources", "error", err, "instance_id", instanceID)
+			err = atlasToAPIError(err)
+			return
+		}
+
+		gid = p.ID
+	}
 
+	// Construct the cluster definitions from the instance ID, service, plan, and params.
+	b.logger.Infow("Creating clusters", "instance_name", planContext["instance_name"])
+	// TODO - add this context info about k8s/namespace or pcf space into labels
+	clusters, err := b.clustersFromParams(instanceID, details.ServiceID, details.PlanID, planContext)
 	if err != nil {
-		b.logger.Errorw("Failed to create Atlas cluster", "error", err, "cluster", cluster)
+		b.logger.Errorw("Couldn't create clusters from the passed parameters", "error", err, "instance_id", instanceID, "details", details)
+		return
+	}
+
+	names := make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		names = append(names, c.Name)
+	}
+
+	s.DashboardURL = b.GetDashboardURL(gid, names[0])
+	s.Parameters = bson.M{
+		"groupID":     gid,
+		"clusterName": names[0],
+	}
+	s.ClusterNames = names
+
+	if b.state != nil {
+		err = b.state.Put(ctx, instancesCollection, instanceID, s)
+		if err != nil {
+			return
+		}
+	}
+
+	// Create the Atlas clusters from the generated definitions.
+	var resultingCluster *mongodbatlas.Cluster
+	err = b.runStep(ctx, op, stepCreateCluster, func() error {
+		for i, cluster := range clusters {
+			c, _, err := client.Clusters.Create(ctx, gid, cluster)
+			if err != nil {
+				return err
+			}
+
+			if i == 0 {
+				resultingCluster = c
+			}
+
+			// Clusters already created are removed if a later one fails.
+			comp.add(cleanupTask{Kind: cleanupDeleteCluster, GroupID: gid, Target: c.Name})
+			b.recordManaged(ctx, instanceID, gid, c.Name)
+		}
+		return nil
+	})
+
+	if err != nil {
+		b.logger.Errorw("Failed to create Atlas cluster", "error", err, "clusters", clusters)
 		err = atlasToAPIError(err)
 		return
 	}
 
-	b.logger.Infow("Successfully started Atlas creation process", "instance_id", instanceID, "cluster", resultingCluster)
+	// The backup policy can only be applied once the clusters are IDLE.
+	err = b.scheduleBackupPolicy(op, details.PlanID, planContext, names)
+	if err != nil {
+		return
+	}
+
+	b.logger.Infow("Successfully started Atlas creation process", "instance_id", instanceID, "clusters", names)
+	b.waitForCluster(ctx, op)
 
 	return domain.ProvisionedServiceSpec{
 		IsAsync:       true,
-		OperationData: OperationProvision,
+		OperationData: operationData(op, OperationProvision),
 		DashboardURL:  b.GetDashboardURL(gid, resultingCluster.Name),
 	}, nil
 }
 
-func (b *Broker) createResources(ctx context.Context, client *mongodbatlas.Client, planID string, planContext dynamicplans.Context) (*mongodbatlas.Project, error) {
-	dp, err := b.parsePlan(planContext, planID)
+// createResources creates the project of a plan along with its settings,
+// network resources, custom roles, database users, IP whitelist and alerts.
+// Every resource created is recorded in the compensation log, and the
+// network resources, roles, alerts and teams in the instance record as well.
+func (b *Broker) createResources(ctx context.Context, op *operation, comp *compensationLog, client *mongodbatlas.Client, s *serviceInstance, planID string, planContext dynamicplans.Context) (*mongodbatlas.Project, error) {
+	dp, err := b.parsePlan(s.ID, planContext, planID)
 	if err != nil {
 		return nil, err
 	}
@@ -136,26 +231,89 @@ func (b *Broker) createResources(ctx context.Context, client *mongodbatlas.Clien
 		return nil, fmt.Errorf("missing Project in plan definition")
 	}
 
-	p, _, err := client.Projects.Create(ctx, dp.Project)
+	var p *mongodbatlas.Project
+	err = b.runStep(ctx, op, stepCreateProject, func() (err error) {
+		p, _, err = client.Projects.Create(ctx, dp.Project)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, u := range dp.DatabaseUsers {
-		_, _, err := client.DatabaseUsers.Create(ctx, p.ID, u)
+	// The org key is needed to manage the new project, including any
+	// rollback of it.
+	b.credentials.AddProject(p.ID, b.credentials.Orgs[p.OrgID])
+	comp.add(cleanupTask{Kind: cleanupDeleteProject, GroupID: p.ID})
+	b.recordManaged(ctx, s.ID, p.ID, "")
+
+	err = b.syncProjectSettings(ctx, op, client, p.ID, s, dp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.createNetwork(ctx, op, comp, client, p.ID, s, dp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.createCustomDBRoles(ctx, op, comp, client, p.ID, s, dp.CustomDBRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dp.DatabaseUsers) > 0 {
+		err = b.runStep(ctx, op, stepCreateDatabaseUsers, func() error {
+			for _, u := range dp.DatabaseUsers {
+				_, _, err := client.DatabaseUsers.Create(ctx, p.ID, u)
+				if err != nil {
+					return err
+				}
+
+				comp.add(cleanupTask{
+					Kind:    cleanupDeleteDatabaseUser,
+					GroupID: p.ID,
+					Target:  u.Username,
+					AuthDB:  u.DatabaseName,
+				})
+			}
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if len(dp.IPWhitelists) > 0 {
-		_, _, err := client.ProjectIPWhitelist.Create(ctx, p.ID, dp.IPWhitelists)
+		err = b.runStep(ctx, op, stepCreateIPWhitelist, func() error {
+			_, _, err := client.ProjectIPWhitelist.Create(ctx, p.ID, dp.IPWhitelists)
+			if err != nil {
+				return err
+			}
+
+			for _, w := range dp.IPWhitelists {
+				entry := w.CIDRBlock
+				if entry == "" {
+					entry = w.IPAddress
+				}
+
+				comp.add(cleanupTask{
+					Kind:    cleanupDeleteIPWhitelistEntry,
+					GroupID: p.ID,
+					Target:  entry,
+				})
+			}
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	b.credentials.Projects[p.ID] = b.credentials.Orgs[p.OrgID]
+	err = b.createAlertConfigurations(ctx, op, comp, client, p.ID, s, dp.AlertConfigurations)
+	if err != nil {
+		return nil, err
+	}
+
 	return p, nil
 }
 
@@ -163,22 +321,56 @@ func (b *Broker) createResources(ctx context.Context, client *mongodbatlas.Clien
 func (b Broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (spec domain.UpdateServiceSpec, err error) {
 	b.logger.Infow("Updating instance", "instance_id", instanceID, "details", details)
 
-	planContext := dynamicplans.Context{
-		"instance_id": instanceID,
+	// The plan ID is only sent if the plan changes.
+	planID := details.PlanID
+	var instance *serviceInstance
+	if b.state != nil {
+		if s, err := b.getInstance(ctx, instanceID); err == nil {
+			instance = s
+			if planID == "" {
+				planID = s.PlanID
+			}
+		}
 	}
 
-	if len(details.RawParameters) > 0 {
-		err = json.Unmarshal(details.RawParameters, &planContext)
-		if err != nil {
-			return
-		}
+	err = b.checkMaintenanceInfo(planID, details.MaintenanceInfo)
+	if err != nil {
+		return
+	}
+
+	// A maintenance info version other than the one the instance was
+	// provisioned from requests an upgrade to the current plan template.
+	upgrade := instance != nil && !details.MaintenanceInfo.NilOrEmpty() && details.MaintenanceInfo.Version != instance.PlanVersion
+
+	err = b.validateParameters(planID, schemaUpdate, details.RawParameters)
+	if err != nil {
+		return
 	}
 
-	if len(details.RawContext) > 0 {
-		err = json.Unmarshal(details.RawContext, &planContext)
+	planContext, err := dynamicplans.NewContext(instanceID, details.RawParameters, details.RawContext)
+	if err != nil {
+		return
+	}
+
+	// Dynamic plans and upgrades re-render the whole plan, so the parameters
+	// the instance was provisioned with are needed as well.
+	rerender := instance != nil && (upgrade || b.mode == DynamicPlans)
+	renderPlanID := details.PlanID
+	if rerender {
+		planContext, err = instanceContext(instance, planContext)
 		if err != nil {
 			return
 		}
+		renderPlanID = planID
+	}
+
+	err = b.checkOverrides(instanceID, planID, planContext, details.RawParameters)
+	if err != nil {
+		return
+	}
+
+	if upgrade {
+		b.logger.Infow("Upgrading instance to new plan version", "instance_id", instanceID, "from", instance.PlanVersion, "to", details.MaintenanceInfo.Version)
 	}
 
 	b.logger.Infow("Update() planContext merged with details.parameters&context",  "planContext", planContext)
@@ -193,10 +385,16 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 		return
 	}
 
-	name, err := b.getClusterNameByInstanceID(ctx, instanceID)
+	names, err := b.getClusterNamesByInstanceID(ctx, instanceID)
+	if err != nil {
+		return
+	}
+
+	op, err := b.startOperation(ctx, instanceID, OperationUpdate)
 	if err != nil {
 		return
 	}
+	defer b.failOperationOnError(ctx, op, &err)
 
 	// special case: pause/unpause
 	if p, ok := planContext["paused"].(bool); ok {
@@ -204,52 +402,112 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 			Paused: &p,
 		}
 
-		_, _, err = client.Clusters.Update(ctx, gid, name, request)
+		err = b.runStep(ctx, op, stepUpdateCluster, func() error {
+			for _, name := range names {
+				if _, _, err := client.Clusters.Update(ctx, gid, name, request); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.logger.Errorw("Failed to pause/resume Atlas cluster", "error", err, "instance_id", instanceID)
+			err = atlasToAPIError(err)
+			return
+		}
+
+		if op != nil {
+			op.succeed()
+			b.saveOperation(ctx, op)
+		}
 		return
 	}
 
-	// Fetch the cluster from Atlas. The Atlas API requires an instance size to
-	// be passed during updates (if there are other update to the provider, such
-	// as region). The plan is not included in the OSB call unless it has changed
-	// hence we need to fetch the current value from Atlas.
-	existingCluster, _, err := client.Clusters.Get(ctx, gid, name)
+	// Construct the clusters from the instance ID, service, plan, and params.
+	// They are matched with the instance's clusters by position.
+	clusters, err := b.clustersFromParams(instanceID, details.ServiceID, renderPlanID, planContext)
 	if err != nil {
-		err = atlasToAPIError(err)
 		return
 	}
-	// Construct a cluster from the instance ID, service, plan, and params.
-	cluster, err := b.clusterFromParams(instanceID, details.ServiceID, details.PlanID, planContext)
+	b.logger.Infow("Update() back clustersFromParams", "clusters", clusters)
+
+	if len(clusters) != len(names) {
+		b.logger.Warnw("Plan defines a different number of clusters than the instance has, only matching clusters are updated", "instance_id", instanceID, "plan_clusters", len(clusters), "instance_clusters", len(names))
+	}
+
+	var resultingCluster *mongodbatlas.Cluster
+	err = b.runStep(ctx, op, stepUpdateCluster, func() error {
+		for i, name := range names {
+			if i >= len(clusters) {
+				break
+			}
+			cluster := clusters[i]
+
+			// Fetch the cluster from Atlas. The Atlas API requires an instance size to
+			// be passed during updates (if there are other update to the provider, such
+			// as region). The plan is not included in the OSB call unless it has changed
+			// hence we need to fetch the current value from Atlas.
+			existingCluster, _, err := client.Clusters.Get(ctx, gid, name)
+			if err != nil {
+				return err
+			}
+
+			// Make sure the cluster provider has all the neccessary params for the
+			// Atlas API. The Atlas API requires both the provider name and instance
+			// size if the provider object is set. If they are missing we use the
+			// existing values.
+			if cluster.ProviderSettings != nil {
+				if cluster.ProviderSettings.ProviderName == "" {
+					cluster.ProviderSettings.ProviderName = existingCluster.ProviderSettings.ProviderName
+				}
+
+				if cluster.ProviderSettings.InstanceSizeName == "" {
+					cluster.ProviderSettings.InstanceSizeName = existingCluster.ProviderSettings.InstanceSizeName
+				}
+			}
+
+			c, _, err := client.Clusters.Update(ctx, gid, existingCluster.Name, cluster)
+			if err != nil {
+				b.logger.Errorw("Failed to update Atlas cluster", "error", err, "cluster", cluster)
+				return err
+			}
+
+			if i == 0 {
+				resultingCluster = c
+			}
+		}
+		return nil
+	})
 	if err != nil {
+		err = atlasToAPIError(err)
 		return
 	}
-	b.logger.Infow("Update() back clusterFromParams",  "cluster", cluster)
 
-	// Make sure the cluster provider has all the neccessary params for the
-	// Atlas API. The Atlas API requires both the provider name and instance
-	// size if the provider object is set. If they are missing we use the
-	// existing values.
-	if cluster.ProviderSettings != nil {
-		if cluster.ProviderSettings.ProviderName == "" {
-			cluster.ProviderSettings.ProviderName = existingCluster.ProviderSettings.ProviderName
+	if rerender {
+		version := instance.PlanVersion
+		if upgrade {
+			version = details.MaintenanceInfo.Version
 		}
 
-		if cluster.ProviderSettings.InstanceSizeName == "" {
-			cluster.ProviderSettings.InstanceSizeName = existingCluster.ProviderSettings.InstanceSizeName
+		err = b.updateInstanceResources(ctx, op, client, gid, instance, renderPlanID, planContext, upgrade, version)
+		if err != nil {
+			b.logger.Errorw("Failed to update instance resources", "error", err, "instance_id", instanceID)
+			err = atlasToAPIError(err)
+			return
 		}
-	}
 
-	resultingCluster, _, err := client.Clusters.Update(ctx, gid, existingCluster.Name, cluster)
-	if err != nil {
-		b.logger.Errorw("Failed to update Atlas cluster", "error", err, "cluster", cluster)
-		err = atlasToAPIError(err)
-		return
+		err = b.scheduleBackupPolicy(op, renderPlanID, planContext, names)
+		if err != nil {
+			return
+		}
 	}
 
-	b.logger.Infow("Successfully started Atlas cluster update process", "instance_id", instanceID, "cluster", resultingCluster)
+	b.logger.Infow("Successfully started Atlas cluster update process", "instance_id", instanceID, "clusters", names)
+	b.waitForCluster(ctx, op)
 
 	return domain.UpdateServiceSpec{
 		IsAsync:       true,
-		OperationData: OperationUpdate,
+		OperationData: operationData(op, OperationUpdate),
 		DashboardURL:  b.GetDashboardURL(gid, resultingCluster.Name),
 	}, nil
 }
@@ -272,60 +530,75 @@ func (b Broker) Deprovision(ctx context.Context, instanceID string, details doma
 		return
 	}
 
-	name, err := b.getClusterNameByInstanceID(ctx, instanceID)
+	names, err := b.getClusterNamesByInstanceID(ctx, instanceID)
 	if err != nil {
 		return
 	}
 
-	_, err = client.Clusters.Delete(ctx, gid, name)
+	op, err := b.startOperation(ctx, instanceID, OperationDeprovision)
+	if err != nil {
+		return
+	}
+	defer b.failOperationOnError(ctx, op, &err)
+
+	err = b.runStep(ctx, op, stepDeleteCluster, func() error {
+		for i, name := range names {
+			r, err := client.Clusters.Delete(ctx, gid, name)
+
+			// Only a missing primary cluster means the instance is gone; any
+			// other cluster may have been removed already.
+			if err != nil && (i == 0 || r == nil || r.StatusCode != http.StatusNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		b.logger.Errorw("Failed to delete Atlas cluster", "error", err, "instance_id", instanceID)
 		err = atlasToAPIError(err)
 		return
 	}
 
-	b.logger.Infow("Successfully started Atlas cluster deletion process", "instance_id", instanceID)
-    go b.CleanupPlan(context.Background(), client, gid)
-	//if err != nil {
-	//	b.logger.Errorw("Failed to clean up plan from Atlas", "error", err, "instance_id", instanceID)
-	//}
+	b.logger.Infow("Successfully started Atlas cluster deletion process", "instance_id", instanceID, "clusters", names)
+	b.waitForCluster(ctx, op)
+
+	// Network resources and the project can only be deleted once the
+	// clusters are gone.
+	if b.state != nil {
+		if s, err := b.getInstance(ctx, instanceID); err == nil {
+			for _, t := range networkCleanupTasks(s, gid) {
+				b.enqueueCleanup(ctx, t, cleanupInitialDelay)
+			}
+		}
+	}
+
+	b.enqueueCleanup(ctx, cleanupTask{
+		Kind:       cleanupDeleteProject,
+		GroupID:    gid,
+		InstanceID: instanceID,
+	}, cleanupInitialDelay)
 
 	return domain.DeprovisionServiceSpec{
 		IsAsync:       true,
-		OperationData: OperationDeprovision,
+		OperationData: operationData(op, OperationDeprovision),
 	}, nil
 }
 
-// Keep trying for awhile to delete the project
-// need to wait until the cluster is cleaned up.
-func (b Broker) CleanupPlan(ctx context.Context, client *mongodbatlas.Client, groupID string) {
-	b.logger.Infow("Plan cleanup started, pausing for cluster cleanup", "groupID", groupID)
-    time.Sleep(30 * time.Second)
-    res, err := client.Projects.Delete(ctx, groupID)
-    if err != nil {
-        b.logger.Errorw("Plan cleanup error. Will try again...","err",err)
-        go b.CleanupPlan(ctx, client, groupID)
-        //if err != nil {
-        //    b.logger.Errorw("Clean up plan error, check logs", "error", err, "groupID", groupID, "instance_id", instanceID)
-        //}
-    } 
-    b.logger.Infow("Plan cleanup complete.","res",res)
-}
-
 // GetInstance is currently not supported as specified by the
 // InstancesRetrievable setting in the service catalog.
 func (b Broker) GetInstance(ctx context.Context, instanceID string) (spec domain.GetInstanceDetailsSpec, err error) {
 	b.logger.Infow("Fetching instance", "instance_id", instanceID)
 
-	if b.client == nil {
+	if b.state == nil {
 		err = apiresponses.NewFailureResponse(errors.New("Fetching instances is not supported in stateless mode"), http.StatusNotImplemented, "get-instance")
 		return
 	}
 
-	c := b.client.Database("atlas-broker").Collection("instances")
-	s := serviceInstance{}
-
-	err = c.FindOne(ctx, bson.M{"id": instanceID}).Decode(&s)
+	s, err := b.getInstance(ctx, instanceID)
+	if err == ErrStateNotFound {
+		err = apiresponses.ErrInstanceNotFound
+		return
+	}
 	if err != nil {
 		return
 	}
@@ -339,10 +612,27 @@ func (b Broker) GetInstance(ctx context.Context, instanceID string) (spec domain
 }
 
 // LastOperation should fetch the state of the provision/deprovision
-// of a cluster.
+// of a cluster. Operations recorded in the journal report the state and
+// description of their current step; the final step completes once the
+// cluster has reached its target state in Atlas.
 func (b Broker) LastOperation(ctx context.Context, instanceID string, details domain.PollDetails) (resp domain.LastOperation, err error) {
 	b.logger.Infow("Fetching state of last operation", "instance_id", instanceID, "details", details)
 
+	op, err := b.getOperation(ctx, details.OperationData)
+	if err != nil {
+		return
+	}
+
+	opType := details.OperationData
+	if op != nil {
+		// Atlas is only consulted once the operation is waiting for the
+		// cluster; earlier steps are still being run by the broker.
+		if s := op.current(); op.State != domain.InProgress || s == nil || s.Name != stepWaitForCluster {
+			return op.lastOperation(), nil
+		}
+		opType = op.Type
+	}
+
 	planContext := dynamicplans.Context{
 		"instance_id": instanceID,
 	}
@@ -351,27 +641,72 @@ func (b Broker) LastOperation(ctx context.Context, instanceID string, details do
 		return
 	}
 
-	name, err := b.getClusterNameByInstanceID(ctx, instanceID)
+	names, err := b.getClusterNamesByInstanceID(ctx, instanceID)
 	if err != nil {
 		return
 	}
 
-	cluster, r, err := client.Clusters.Get(ctx, gid, name)
-	if err != nil && r.StatusCode != http.StatusNotFound {
-		b.logger.Errorw("Failed to get existing cluster", "error", err, "instance_id", instanceID)
-		err = atlasToAPIError(err)
-		return
+	// The operation is only complete once every cluster of the instance is.
+	state := domain.LastOperationState(domain.Succeeded)
+	clusterStates := []string{}
+	for _, name := range names {
+		cluster, r, err := client.Clusters.Get(ctx, gid, name)
+		notFound := r != nil && r.StatusCode == http.StatusNotFound
+		if err != nil && !notFound {
+			b.logger.Errorw("Failed to get existing cluster", "error", err, "instance_id", instanceID)
+			return resp, atlasToAPIError(err)
+		}
+
+		b.logger.Infow("Found existing cluster", "cluster", cluster)
+
+		s, d := clusterOperationState(opType, cluster, notFound)
+		switch {
+		case s == domain.Failed:
+			state = domain.Failed
+		case s == domain.InProgress && state != domain.Failed:
+			state = domain.InProgress
+		}
+
+		if len(names) > 1 {
+			d = fmt.Sprintf("%s: %s", name, d)
+		}
+		clusterStates = append(clusterStates, d)
 	}
+	detail := strings.Join(clusterStates, ", ")
 
-	b.logger.Infow("Found existing cluster", "cluster", cluster)
+	if opType == OperationDeprovision && state == domain.Succeeded && b.state != nil {
+		err := b.state.Delete(ctx, instancesCollection, instanceID)
+		if err != nil {
+			b.logger.Errorw("Failed to clean up instance from state store", "error", err, "instance_id", instanceID)
+		}
+	}
+
+	if op != nil {
+		b.updateWaitForCluster(ctx, op, state, detail)
+		if state == domain.Succeeded && op.State == domain.InProgress && op.BackupPolicy != nil {
+			b.applyBackupPolicy(ctx, op, client, gid)
+		}
+		return op.lastOperation(), nil
+	}
+
+	return domain.LastOperation{
+		State: state,
+	}, nil
+}
 
+// clusterOperationState returns the state of an operation on a single
+// cluster, along with the cluster state reported by Atlas.
+func clusterOperationState(opType string, cluster *mongodbatlas.Cluster, notFound bool) (domain.LastOperationState, string) {
 	state := domain.LastOperationState(domain.Failed)
+	detail := ""
+	if !notFound {
+		detail = cluster.StateName
+	}
 
-	switch details.OperationData {
+	switch opType {
 	case OperationProvision, OperationUpdate:
-		if r.StatusCode == http.StatusNotFound {
-			state = domain.Failed
-			break
+		if notFound {
+			return domain.Failed, "cluster not found"
 		}
 
 		switch cluster.StateName {
@@ -385,23 +720,14 @@ func (b Broker) LastOperation(ctx context.Context, instanceID string, details do
 		// The Atlas API may return a 404 response if a cluster is deleted or it
 		// will return the cluster with a state of "DELETED". Both of these
 		// scenarios indicate that a cluster has been successfully deleted.
-		if r.StatusCode == http.StatusNotFound || cluster.StateName == "DELETED" {
+		if notFound || cluster.StateName == "DELETED" {
 			state = domain.Succeeded
-			if b.client != nil {
-				// TODO: change this?
-                _, err := b.client.Database("atlas-broker").Collection("instances").DeleteOne(ctx, bson.M{"id": instanceID})
-                if err != nil {
-                    b.logger.Errorw("Failed to clean up instance from maintenance store","err",err)
-                }
-			}
 		} else if cluster.StateName == "DELETING" {
 			state = domain.InProgress
 		}
 	}
 
-	return domain.LastOperation{
-		State: state,
-	}, nil
+	return state, detail
 }
 
 // NormalizeClusterName will sanitize a name to make sure it will be accepted
@@ -418,16 +744,35 @@ func NormalizeClusterName(name string) string {
 	return name
 }
 
-// clusterFromParams will construct a cluster object from an instance ID,
-// service, plan, and raw parameters. This way users can pass all the
-// configuration available for clusters in the Atlas API as "cluster" in the params.
-func (b Broker) clusterFromParams(instanceID string, serviceID string, planID string, planContext dynamicplans.Context) (*mongodbatlas.Cluster, error) {
+// clustersFromParams constructs the clusters of an instance. Dynamic plans
+// can define several clusters, the primary cluster first; the other modes
+// always have a single one.
+func (b Broker) clustersFromParams(instanceID string, serviceID string, planID string, planContext dynamicplans.Context) ([]*mongodbatlas.Cluster, error) {
 	// In template mode, everything is handled by the template itself.
 	if b.mode == DynamicPlans {
-		dp, err := b.parsePlan(planContext, planID)
-		return dp.Cluster, err
+		dp, err := b.parsePlan(instanceID, planContext, planID)
+		if err != nil {
+			return nil, err
+		}
+
+		clusters := dp.AllClusters()
+		if len(clusters) == 0 {
+			return nil, fmt.Errorf("missing Cluster in plan definition")
+		}
+		return clusters, nil
 	}
 
+	c, err := b.clusterFromParams(instanceID, serviceID, planID, planContext)
+	if err != nil {
+		return nil, err
+	}
+	return []*mongodbatlas.Cluster{c}, nil
+}
+
+// clusterFromParams will construct a cluster object from an instance ID,
+// service, plan, and raw parameters. This way users can pass all the
+// configuration available for clusters in the Atlas API as "cluster" in the params.
+func (b Broker) clusterFromParams(instanceID string, serviceID string, planID string, planContext dynamicplans.Context) (*mongodbatlas.Cluster, error) {
 	// workaround for old modes
 	var context struct {
 		Cluster *mongodbatlas.Cluster `json:"cluster"`
@@ -446,12 +791,12 @@ func (b Broker) clusterFromParams(instanceID string, serviceID string, planID st
 
 		instanceSizeName := context.Cluster.ProviderSettings.InstanceSizeName
 		if instanceSizeName != InstanceSizeNameM2 && instanceSizeName != InstanceSizeNameM5 {
-			provider, err := b.catalog.findProviderByServiceID(serviceID)
+			provider, err := b.getCatalog().findProviderByServiceID(serviceID)
 			if err != nil {
 				return nil, err
 			}
 
-			instanceSize, err := b.catalog.findInstanceSizeByPlanID(planID)
+			instanceSize, err := b.getCatalog().findInstanceSizeByPlanID(planID)
 			if err != nil {
 				return nil, err
 			}
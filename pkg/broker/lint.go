@@ -0,0 +1,411 @@
+package broker
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+)
+
+// Cloud providers accepted in plan templates.
+var planProviders = map[string]bool{
+	"AWS":    true,
+	"GCP":    true,
+	"AZURE":  true,
+	"TENANT": true,
+}
+
+// Snapshot frequencies and retention units accepted in backup policies.
+var (
+	backupFrequencies    = map[string]bool{"hourly": true, "daily": true, "weekly": true, "monthly": true}
+	backupRetentionUnits = map[string]bool{"days": true, "weeks": true, "months": true}
+)
+
+var (
+	instanceSizePattern  = regexp.MustCompile(`^[MR][0-9]+(_NVME)?$`)
+	regionNamePattern    = regexp.MustCompile(`^[A-Z0-9_]+$`)
+	serviceNamePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	versionPattern       = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+	templateErrorPattern = regexp.MustCompile(`(?s)^template: [^:]*:([0-9]+)(?::[0-9]+)?: (.*)$`)
+)
+
+// planIssue is a structural problem in a decoded plan. The field is the
+// YAML path of the offending value, used to find its line in the template.
+type planIssue struct {
+	field   string
+	message string
+}
+
+// checkPlan runs structural checks on a plan decoded from a template. Plans
+// rendered for the catalog have no instance parameters, so checks depending
+// on them are only run if provisioning is set.
+func checkPlan(p *dynamicplans.Plan, provisioning bool) []planIssue {
+	issues := []planIssue{}
+	add := func(field string, format string, args ...interface{}) {
+		issues = append(issues, planIssue{field: field, message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.Name == "" {
+		add("name", ".name must not be empty")
+	}
+	if p.Description == "" {
+		add("description", ".description must not be empty")
+	}
+	if p.Version != "" && !versionPattern.MatchString(p.Version) {
+		add("version", ".version %q is not a semantic version", p.Version)
+	}
+	if p.Service != nil {
+		switch {
+		case p.Service.Name == "":
+			add("service.name", ".service.name must not be empty")
+		case !serviceNamePattern.MatchString(p.Service.Name):
+			add("service.name", ".service.name %q must only contain lowercase letters, digits and dashes", p.Service.Name)
+		}
+	}
+
+	if p.Quota != nil {
+		if err := checkQuota(*p.Quota); err != nil {
+			add("quota", ".quota: %v", err)
+		}
+	}
+
+	if err := p.Parameters.Check(); err != nil {
+		add("parameters", ".parameters: %v", err)
+	}
+
+	for _, o := range p.Overridable {
+		if !dynamicplans.IsPlanField(strings.Split(o, ".")[0]) {
+			add("overridable", ".overridable %q does not name a plan field", o)
+		}
+	}
+
+	checkCluster := func(field string, path string, c *mongodbatlas.Cluster) {
+		if c.ProviderSettings == nil {
+			add(field+".providerSettings", "%s.providerSettings must be set", path)
+			return
+		}
+		ps := c.ProviderSettings
+
+		switch {
+		case ps.ProviderName == "":
+			add(field+".providerSettings.providerName", "%s.providerSettings.providerName must not be empty", path)
+		case !planProviders[ps.ProviderName]:
+			add(field+".providerSettings.providerName", "%s.providerSettings.providerName %q is not one of AWS, GCP, AZURE or TENANT", path, ps.ProviderName)
+		case ps.ProviderName == "TENANT" && ps.BackingProviderName == "":
+			add(field+".providerSettings.backingProviderName", "%s.providerSettings.backingProviderName must be set for TENANT clusters", path)
+		}
+
+		switch {
+		case ps.InstanceSizeName == "":
+			add(field+".providerSettings.instanceSizeName", "%s.providerSettings.instanceSizeName must not be empty", path)
+		case !instanceSizePattern.MatchString(ps.InstanceSizeName):
+			add(field+".providerSettings.instanceSizeName", "%s.providerSettings.instanceSizeName %q is not a valid instance size", path, ps.InstanceSizeName)
+		}
+
+		switch {
+		case ps.RegionName == "" && len(c.ReplicationSpecs) == 0:
+			add(field+".providerSettings.regionName", "%s.providerSettings.regionName must be set unless %s.replicationSpecs is given", path, path)
+		case ps.RegionName != "" && !regionNamePattern.MatchString(ps.RegionName):
+			add(field+".providerSettings.regionName", "%s.providerSettings.regionName %q is not a valid region name", path, ps.RegionName)
+		}
+	}
+
+	clusters := p.AllClusters()
+	if len(clusters) == 0 {
+		add("cluster", ".cluster or .clusters must be set")
+	}
+	if p.Cluster != nil {
+		checkCluster("cluster", ".cluster", p.Cluster)
+	}
+	for i, c := range p.Clusters {
+		if c != nil {
+			checkCluster("clusters", fmt.Sprintf(".clusters[%d]", i), c)
+		}
+	}
+
+	if !provisioning {
+		return issues
+	}
+
+	if p.Project == nil {
+		add("project", ".project must be set")
+	} else if p.Project.ID == "" && p.Project.OrgID == "" {
+		add("project", ".project must have either an id or an orgId")
+	}
+
+	if w := p.MaintenanceWindow; w != nil {
+		if w.DayOfWeek < mongodbatlas.Sunday || w.DayOfWeek > mongodbatlas.Saturday {
+			add("maintenanceWindow", ".maintenanceWindow.dayOfWeek must be between 1 (Sunday) and 7 (Saturday)")
+		}
+		if w.HourOfDay == nil || *w.HourOfDay < 0 || *w.HourOfDay > 23 {
+			add("maintenanceWindow", ".maintenanceWindow.hourOfDay must be between 0 and 23")
+		}
+	}
+
+	for i, t := range p.Teams {
+		if t.TeamID == "" || len(t.RoleNames) == 0 {
+			add("teams", ".teams[%d] must have a teamId and roleNames", i)
+		}
+	}
+
+	// Clusters are told apart by name, so the names of several clusters
+	// must be set and distinct.
+	if len(clusters) > 1 {
+		names := map[string]bool{}
+		for _, c := range clusters {
+			switch {
+			case c.Name == "":
+				add("clusters", "clusters of a plan with several clusters must have a name")
+			case names[c.Name]:
+				add("clusters", "cluster name %q is used more than once", c.Name)
+			}
+			names[c.Name] = true
+		}
+	}
+
+	for i, u := range p.DatabaseUsers {
+		if u.Username == "" {
+			add("databaseUsers", ".databaseUsers[%d].username must not be empty", i)
+		}
+	}
+
+	for i, c := range p.NetworkContainers {
+		if c.ProviderName == "" || c.AtlasCIDRBlock == "" {
+			add("networkContainers", ".networkContainers[%d] must have a providerName and an atlasCidrBlock", i)
+		}
+	}
+
+	for i, peer := range p.NetworkPeering {
+		if peer.ContainerID == "" && p.PeerContainer(peer) < 0 {
+			add("networkPeering", ".networkPeering[%d] has no containerId and the plan has no network container for its provider", i)
+		}
+	}
+
+	for i, e := range p.PrivateEndpoints {
+		if e.ProviderName == "" || e.Region == "" {
+			add("privateEndpoints", ".privateEndpoints[%d] must have a providerName and a region", i)
+		}
+	}
+
+	for i, r := range p.CustomDBRoles {
+		if r.RoleName == "" {
+			add("customDBRoles", ".customDBRoles[%d].roleName must not be empty", i)
+		}
+	}
+
+	for i, a := range p.AlertConfigurations {
+		if a.EventTypeName == "" {
+			add("alertConfigurations", ".alertConfigurations[%d].eventTypeName must not be empty", i)
+		}
+	}
+
+	if bp := p.BackupPolicy; bp != nil {
+		// Compliance requires explicit settings, so Atlas defaults are not
+		// relied upon for the restore window or retention.
+		if bp.RestoreWindowDays == nil || *bp.RestoreWindowDays <= 0 {
+			add("backupPolicy", ".backupPolicy.restoreWindowDays must be a positive number of days")
+		}
+		if len(bp.Policies) == 0 {
+			add("backupPolicy", ".backupPolicy.policies must not be empty")
+		}
+		for i, policy := range bp.Policies {
+			for j, item := range policy.PolicyItems {
+				path := fmt.Sprintf(".backupPolicy.policies[%d].policyItems[%d]", i, j)
+				if !backupFrequencies[item.FrequencyType] {
+					add("backupPolicy", "%s.frequencyType %q is not one of hourly, daily, weekly or monthly", path, item.FrequencyType)
+				}
+				if !backupRetentionUnits[item.RetentionUnit] || item.RetentionValue <= 0 {
+					add("backupPolicy", "%s must have a retentionValue in days, weeks or months", path)
+				}
+			}
+		}
+
+		backups := false
+		for _, c := range clusters {
+			backups = backups || (c.ProviderBackupEnabled != nil && *c.ProviderBackupEnabled)
+		}
+		if !backups {
+			add("backupPolicy", ".backupPolicy is set but no cluster has providerBackupEnabled")
+		}
+	}
+
+	for i, w := range p.IPWhitelists {
+		if w.IPAddress == "" && w.CIDRBlock == "" {
+			add("ipWhitelists", ".ipWhitelists[%d] must have an ipAddress or a cidrBlock", i)
+		}
+	}
+
+	return issues
+}
+
+// declaredService is a service block along with the template it was first
+// declared in.
+type declaredService struct {
+	file    string
+	service *dynamicplans.Service
+}
+
+// LintIssue is a problem found in a plan template.
+type LintIssue struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (i LintIssue) String() string {
+	if i.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", i.File, i.Message)
+}
+
+// LintTemplates loads the plan templates of a source the same way the
+// broker does and reports every problem found. Each template is rendered
+// once with an empty context, as it is for the catalog, and once for each of
+// the sample provisioning contexts.
+func LintTemplates(src dynamicplans.Source, creds *credentials.Credentials, samples []dynamicplans.Context) ([]LintIssue, error) {
+	sourceFiles, err := src.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every template is parsed before any is rendered, as plans can extend
+	// templates parsed after them.
+	issues := []LintIssue{}
+	files := []string{}
+	texts := map[string]string{}
+	templates := map[string]*template.Template{}
+	for _, f := range dynamicplans.ParseFiles(sourceFiles) {
+		if f.Err != nil {
+			issues = append(issues, templateErrorIssue(f.Name, f.Err))
+		}
+		if f.Partial {
+			continue
+		}
+
+		files = append(files, f.Name)
+		if f.Err == nil {
+			texts[f.Name] = f.Text
+			templates[f.Name] = f.Template
+		}
+	}
+
+	if len(files) == 0 {
+		return append(issues, LintIssue{File: src.String(), Message: "no templates found"}), nil
+	}
+
+	names := map[string]string{}
+	ids := map[string]string{}
+	services := map[string]declaredService{}
+
+	for _, f := range files {
+		t, ok := templates[f]
+		if !ok {
+			continue
+		}
+		text := texts[f]
+
+		contexts := append([]dynamicplans.Context{{}}, samples...)
+		for i, ctx := range contexts {
+			provisioning := i > 0
+			where := "catalog"
+			if provisioning {
+				where = fmt.Sprintf("sample context %d", i)
+			}
+
+			instanceID, _ := ctx["instance_id"].(string)
+			raw, err := dynamicplans.Render(t, ctx, dynamicplans.RenderOptions{InstanceID: instanceID, Credentials: creds})
+			if err != nil {
+				issue := templateErrorIssue(f, err)
+				issue.Message = fmt.Sprintf("%s (%s)", issue.Message, where)
+				issues = append(issues, issue)
+				continue
+			}
+
+			p := dynamicplans.Plan{}
+			if err := yaml.NewDecoder(raw).Decode(&p); err != nil {
+				msg := strings.SplitN(err.Error(), "\n", 2)[0]
+				issues = append(issues, LintIssue{File: f, Message: fmt.Sprintf("cannot decode rendered plan (%s): %s", where, msg)})
+				continue
+			}
+
+			for _, pi := range checkPlan(&p, provisioning) {
+				issues = append(issues, LintIssue{
+					File:    f,
+					Line:    lineOf(text, pi.field),
+					Message: fmt.Sprintf("%s (%s)", pi.message, where),
+				})
+			}
+
+			if provisioning || p.Name == "" {
+				continue
+			}
+
+			// All plans of a service must declare it the same way.
+			svc := serviceForPlan(p)
+			if other, ok := services[svc.ID]; !ok {
+				services[svc.ID] = declaredService{file: f, service: p.Service}
+			} else if !reflect.DeepEqual(other.service, p.Service) {
+				issues = append(issues, LintIssue{File: f, Line: lineOf(text, "service"), Message: fmt.Sprintf("service %q is declared differently in %s", svc.ID, other.file)})
+			}
+
+			// Plan names must be unique within their service, and plan IDs
+			// across the catalog.
+			name := svc.ID + "/" + p.Name
+			if other, ok := names[name]; ok {
+				issues = append(issues, LintIssue{File: f, Line: lineOf(text, "name"), Message: fmt.Sprintf("duplicate plan name %q, also used in %s", p.Name, other)})
+			} else if other, ok := ids[dynamicPlanID(p)]; ok {
+				issues = append(issues, LintIssue{File: f, Line: lineOf(text, "name"), Message: fmt.Sprintf("plan name %q results in the same plan ID as the plan in %s", p.Name, other)})
+			}
+			names[name] = f
+			ids[dynamicPlanID(p)] = f
+		}
+	}
+
+	return issues, nil
+}
+
+// templateErrorIssue converts a template parse or execution error, which
+// carries the line number in its message, into a lint issue.
+func templateErrorIssue(file string, err error) LintIssue {
+	m := templateErrorPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return LintIssue{File: file, Message: err.Error()}
+	}
+
+	line, _ := strconv.Atoi(m[1])
+	return LintIssue{File: file, Line: line, Message: m[2]}
+}
+
+// lineOf finds the line of a dotted YAML path in a template by looking for
+// each key in turn. If only part of the path is found, the line of the
+// deepest key found is returned; 0 means none was found.
+func lineOf(text string, path string) int {
+	lines := strings.Split(text, "\n")
+
+	line := 0
+	for _, key := range strings.Split(path, ".") {
+		found := false
+		for i := line; i < len(lines); i++ {
+			l := strings.TrimLeft(strings.TrimSpace(lines[i]), "- ")
+			if strings.HasPrefix(l, key+":") {
+				line = i + 1
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			break
+		}
+	}
+
+	return line
+}
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintSamplePlans(t *testing.T) {
+	creds := &credentials.Credentials{
+		Orgs: map[string]credentials.APIKey{"org": {}},
+	}
+	samples := []dynamicplans.Context{{
+		"instance_name": "instance",
+		"org_id":        "org",
+	}}
+
+	issues, err := LintTemplates(dynamicplans.DirSource{Path: "../../samples/plans"}, creds, samples)
+	assert.NoError(t, err)
+	assert.Empty(t, issues)
+}
+
+// fileSource is a template source holding its files in memory.
+type fileSource map[string]string
+
+func (s fileSource) Files() (map[string]string, error) {
+	return s, nil
+}
+
+func (s fileSource) String() string {
+	return "test files"
+}
+
+func TestLintTemplates(t *testing.T) {
+	src := fileSource{
+		"unclosed.yml.tpl": "name: broken\ndescription: {{ .name\n",
+		"invalid.yml.tpl": `name: invalid
+description: Invalid plan
+cluster:
+  providerSettings:
+    providerName: AWS
+    instanceSizeName: huge
+    regionName: US_EAST_1
+`,
+		"missing.yml.tpl":   "name: missing\ndescription: Missing cluster\n",
+		"duplicate.yml.tpl": "name: INVALID\ndescription: Duplicate plan ID\ncluster:\n  providerSettings:\n    providerName: AWS\n    instanceSizeName: M10\n    regionName: US_EAST_1\n",
+		"README.md":         "Not a template",
+	}
+
+	issues, err := LintTemplates(src, &credentials.Credentials{}, nil)
+	assert.NoError(t, err)
+
+	byFile := map[string][]LintIssue{}
+	for _, i := range issues {
+		byFile[i.File] = append(byFile[i.File], i)
+	}
+
+	assert.Len(t, issues, 4)
+
+	if assert.Len(t, byFile["unclosed.yml.tpl"], 1) {
+		assert.True(t, byFile["unclosed.yml.tpl"][0].Line > 0)
+	}
+
+	if assert.Len(t, byFile["invalid.yml.tpl"], 2) {
+		assert.Equal(t, 6, byFile["invalid.yml.tpl"][0].Line)
+		assert.Contains(t, byFile["invalid.yml.tpl"][1].Message, "same plan ID")
+	}
+
+	if assert.Len(t, byFile["missing.yml.tpl"], 1) {
+		assert.Equal(t, ".cluster or .clusters must be set (catalog)", byFile["missing.yml.tpl"][0].Message)
+	}
+}
+
+func TestLineOf(t *testing.T) {
+	text := `name: plan
+project:
+  name: project
+cluster:
+  name: cluster
+  providerSettings:
+    providerName: AWS
+`
+
+	assert.Equal(t, 1, lineOf(text, "name"))
+	assert.Equal(t, 5, lineOf(text, "cluster.name"))
+	assert.Equal(t, 7, lineOf(text, "cluster.providerSettings.providerName"))
+	assert.Equal(t, 6, lineOf(text, "cluster.providerSettings.regionName"))
+	assert.Equal(t, 0, lineOf(text, "databaseUsers"))
+}
+
+func TestCheckPlanClusters(t *testing.T) {
+	settings := func(size string) *mongodbatlas.ProviderSettings {
+		return &mongodbatlas.ProviderSettings{
+			ProviderName:     "AWS",
+			InstanceSizeName: size,
+			RegionName:       "US_EAST_1",
+		}
+	}
+
+	p := &dynamicplans.Plan{
+		Name:        "multi",
+		Description: "Plan with several clusters",
+		Project:     &mongodbatlas.Project{OrgID: "org"},
+		Cluster:     &mongodbatlas.Cluster{Name: "oltp", ProviderSettings: settings("M30")},
+		Clusters: []*mongodbatlas.Cluster{
+			{Name: "analytics", ProviderSettings: settings("M40")},
+		},
+	}
+	assert.Empty(t, checkPlan(p, true))
+	assert.Len(t, p.AllClusters(), 2)
+
+	p.Clusters = append(p.Clusters, &mongodbatlas.Cluster{Name: "oltp", ProviderSettings: settings("huge")})
+	issues := checkPlan(p, true)
+	if assert.Len(t, issues, 2) {
+		assert.Equal(t, `.clusters[1].providerSettings.instanceSizeName "huge" is not a valid instance size`, issues[0].message)
+		assert.Equal(t, `cluster name "oltp" is used more than once`, issues[1].message)
+	}
+
+	p.Cluster = nil
+	p.Clusters = nil
+	issues = checkPlan(p, false)
+	if assert.Len(t, issues, 1) {
+		assert.Equal(t, ".cluster or .clusters must be set", issues[0].message)
+	}
+}
+
+func TestCheckPlanNetwork(t *testing.T) {
+	p := &dynamicplans.Plan{
+		Name:        "private",
+		Description: "Plan with network peering",
+		Project:     &mongodbatlas.Project{OrgID: "org"},
+		Cluster: &mongodbatlas.Cluster{ProviderSettings: &mongodbatlas.ProviderSettings{
+			ProviderName:     "AWS",
+			InstanceSizeName: "M30",
+			RegionName:       "US_EAST_1",
+		}},
+		NetworkContainers: []*mongodbatlas.Container{
+			{ProviderName: "GCP", AtlasCIDRBlock: "10.8.0.0/18"},
+			{ProviderName: "AWS", AtlasCIDRBlock: "10.9.0.0/21", RegionName: "US_EAST_1"},
+		},
+		NetworkPeering: []*mongodbatlas.Peer{
+			{ProviderName: "AWS", VpcID: "vpc-1"},
+		},
+	}
+	assert.Empty(t, checkPlan(p, true))
+	assert.Equal(t, 1, p.PeerContainer(p.NetworkPeering[0]))
+
+	p.NetworkPeering = append(p.NetworkPeering, &mongodbatlas.Peer{ProviderName: "AZURE"})
+	issues := checkPlan(p, true)
+	if assert.Len(t, issues, 1) {
+		assert.Equal(t, "networkPeering", issues[0].field)
+	}
+}
+
+func TestCheckPlanBackupPolicy(t *testing.T) {
+	backups := true
+	days := int64(7)
+	p := &dynamicplans.Plan{
+		Name:        "compliant",
+		Description: "Plan with explicit retention",
+		Project:     &mongodbatlas.Project{OrgID: "org"},
+		Cluster: &mongodbatlas.Cluster{
+			ProviderBackupEnabled: &backups,
+			ProviderSettings: &mongodbatlas.ProviderSettings{
+				ProviderName:     "AWS",
+				InstanceSizeName: "M30",
+				RegionName:       "US_EAST_1",
+			},
+		},
+		BackupPolicy: &mongodbatlas.CloudProviderSnapshotBackupPolicy{
+			RestoreWindowDays: &days,
+			Policies: []mongodbatlas.Policy{{PolicyItems: []mongodbatlas.PolicyItem{
+				{FrequencyType: "daily", FrequencyInterval: 1, RetentionUnit: "days", RetentionValue: 7},
+				{FrequencyType: "monthly", FrequencyInterval: 1, RetentionUnit: "months", RetentionValue: 12},
+			}}},
+		},
+	}
+	assert.Empty(t, checkPlan(p, true))
+
+	p.BackupPolicy.RestoreWindowDays = nil
+	p.BackupPolicy.Policies[0].PolicyItems[1].FrequencyType = "yearly"
+	p.Cluster.ProviderBackupEnabled = nil
+	assert.Equal(t, []planIssue{
+		{field: "backupPolicy", message: ".backupPolicy.restoreWindowDays must be a positive number of days"},
+		{field: "backupPolicy", message: `.backupPolicy.policies[0].policyItems[1].frequencyType "yearly" is not one of hourly, daily, weekly or monthly`},
+		{field: "backupPolicy", message: ".backupPolicy is set but no cluster has providerBackupEnabled"},
+	}, checkPlan(p, true))
+}
+
+func TestCheckPlanProjectSettings(t *testing.T) {
+	hour := 24
+	p := &dynamicplans.Plan{
+		Name:        "standard",
+		Description: "Plan following the org standards",
+		Project:     &mongodbatlas.Project{OrgID: "org"},
+		Cluster: &mongodbatlas.Cluster{ProviderSettings: &mongodbatlas.ProviderSettings{
+			ProviderName:     "AWS",
+			InstanceSizeName: "M10",
+			RegionName:       "US_EAST_1",
+		}},
+		MaintenanceWindow: &mongodbatlas.MaintenanceWindow{DayOfWeek: 8, HourOfDay: &hour},
+		Teams:             []*mongodbatlas.ProjectTeam{{TeamID: "team"}},
+	}
+
+	fields := []string{}
+	for _, i := range checkPlan(p, true) {
+		fields = append(fields, i.field)
+	}
+	assert.Equal(t, []string{"maintenanceWindow", "maintenanceWindow", "teams"}, fields)
+}
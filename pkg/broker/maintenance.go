@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// maintenanceInfoForPlan returns the maintenance info published in the
+// catalog for a dynamic plan. Plans without a version have none.
+func maintenanceInfoForPlan(p dynamicplans.Plan) *domain.MaintenanceInfo {
+	if p.Version == "" {
+		return nil
+	}
+
+	return &domain.MaintenanceInfo{Version: p.Version}
+}
+
+// planVersion returns the version of a plan as published in the catalog.
+func (b *Broker) planVersion(planID string) string {
+	plan, ok := b.getCatalog().plans[planID]
+	if !ok || plan.MaintenanceInfo == nil {
+		return ""
+	}
+
+	return plan.MaintenanceInfo.Version
+}
+
+// checkMaintenanceInfo makes sure the maintenance info of a request matches
+// the one the plan currently publishes. Platforms send the catalog value, so
+// a mismatch means the platform is working from an outdated catalog.
+func (b *Broker) checkMaintenanceInfo(planID string, info domain.MaintenanceInfo) error {
+	if info.NilOrEmpty() {
+		return nil
+	}
+
+	plan, ok := b.getCatalog().plans[planID]
+	if !ok || plan.MaintenanceInfo == nil {
+		return apiresponses.ErrMaintenanceInfoNilConflict
+	}
+
+	if !plan.MaintenanceInfo.Equals(info) {
+		return apiresponses.ErrMaintenanceInfoConflict
+	}
+
+	return nil
+}
+
+// instanceContext returns the context an existing instance is re-rendered
+// with. Parameters from the update request are merged over the ones the
+// instance was provisioned with.
+func instanceContext(s *serviceInstance, planContext dynamicplans.Context) (dynamicplans.Context, error) {
+	c, err := dynamicplans.NewContext(s.ID, []byte(s.RawParameters), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range planContext {
+		c[k] = v
+	}
+
+	return c, nil
+}
+
+// updateInstanceResources brings the project resources of an instance in
+// line with its re-rendered plan and records the plan version. Project
+// settings, custom roles and alerts are synced on every update; database
+// users and the IP whitelist only on upgrades to a new plan version. The
+// clusters themselves are updated like for any other update.
+func (b *Broker) updateInstanceResources(ctx context.Context, op *operation, client *mongodbatlas.Client, gid string, s *serviceInstance, planID string, planContext dynamicplans.Context, upgrade bool, version string) (err error) {
+	// Resources created before a step fails are recorded all the same, so
+	// the next update syncs or removes them.
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if perr := b.state.Put(ctx, instancesCollection, s.ID, s); perr != nil {
+			b.logger.Errorw("Failed to record instance resources", "error", perr, "instance_id", s.ID)
+		}
+	}()
+
+	if b.mode == DynamicPlans {
+		dp, err := b.parsePlan(s.ID, planContext, planID)
+		if err != nil {
+			return err
+		}
+
+		err = b.syncProjectSettings(ctx, op, client, gid, s, dp)
+		if err != nil {
+			return err
+		}
+
+		// Roles come first so users can be granted them.
+		err = b.syncCustomDBRoles(ctx, op, client, gid, s, dp.CustomDBRoles)
+		if err != nil {
+			return err
+		}
+
+		if upgrade {
+			err = b.applyPlanUpgrade(ctx, op, client, gid, dp)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = b.syncAlertConfigurations(ctx, op, client, gid, s, dp.AlertConfigurations)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.PlanID = planID
+	s.PlanVersion = version
+	return b.state.Put(ctx, instancesCollection, s.ID, s)
+}
+
+// applyPlanUpgrade applies the database users and IP whitelist of a
+// re-rendered plan to the project of an existing instance. Users in the plan
+// are created or updated; users and whitelist entries which were dropped from
+// the plan are left in place.
+func (b *Broker) applyPlanUpgrade(ctx context.Context, op *operation, client *mongodbatlas.Client, gid string, dp dynamicplans.Plan) error {
+	if len(dp.DatabaseUsers) > 0 {
+		err := b.runStep(ctx, op, stepApplyDatabaseUsers, func() error {
+			for _, u := range dp.DatabaseUsers {
+				_, r, err := client.DatabaseUsers.Get(ctx, u.DatabaseName, gid, u.Username)
+				if err != nil && r != nil && r.StatusCode == http.StatusNotFound {
+					_, _, err = client.DatabaseUsers.Create(ctx, gid, u)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				_, _, err = client.DatabaseUsers.Update(ctx, gid, u.Username, u)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(dp.IPWhitelists) > 0 {
+		// Creating whitelist entries which already exist updates them.
+		err := b.runStep(ctx, op, stepApplyIPWhitelist, func() error {
+			_, _, err := client.ProjectIPWhitelist.Create(ctx, gid, dp.IPWhitelists)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCheckMaintenanceInfo(t *testing.T) {
+	c := newCatalog()
+	c.plans["versioned"] = domain.ServicePlan{
+		ID:              "versioned",
+		MaintenanceInfo: &domain.MaintenanceInfo{Version: "1.2.0"},
+	}
+	c.plans["unversioned"] = domain.ServicePlan{ID: "unversioned"}
+
+	b := &Broker{
+		logger:         zap.NewNop().Sugar(),
+		currentCatalog: &atomic.Value{},
+	}
+	b.currentCatalog.Store(c)
+
+	assert.Equal(t, "1.2.0", b.planVersion("versioned"))
+	assert.Equal(t, "", b.planVersion("unversioned"))
+
+	assert.NoError(t, b.checkMaintenanceInfo("versioned", domain.MaintenanceInfo{}))
+	assert.NoError(t, b.checkMaintenanceInfo("versioned", domain.MaintenanceInfo{Version: "1.2.0"}))
+	assert.Equal(t, apiresponses.ErrMaintenanceInfoConflict, b.checkMaintenanceInfo("versioned", domain.MaintenanceInfo{Version: "1.1.0"}))
+	assert.Equal(t, apiresponses.ErrMaintenanceInfoNilConflict, b.checkMaintenanceInfo("unversioned", domain.MaintenanceInfo{Version: "1.2.0"}))
+}
+
+func TestInstanceContext(t *testing.T) {
+	s := &serviceInstance{
+		ID:            "instance",
+		RawParameters: `{"instance_name":"test","instance_size":"M10"}`,
+	}
+
+	c, err := instanceContext(s, map[string]interface{}{
+		"instance_id":   "instance",
+		"instance_size": "M30",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "instance", c["instance_id"])
+	assert.Equal(t, "test", c["instance_name"])
+	assert.Equal(t, "M30", c["instance_size"])
+}
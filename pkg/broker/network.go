@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+)
+
+// createNetwork creates the network containers, peering connections and
+// private endpoints of a plan. Containers have to exist before the clusters
+// are created in them, and peering connections without a containerId are
+// attached to the plan's container for the same provider.
+func (b *Broker) createNetwork(ctx context.Context, op *operation, comp *compensationLog, client *mongodbatlas.Client, gid string, s *serviceInstance, dp dynamicplans.Plan) error {
+	if len(dp.NetworkContainers) == 0 && len(dp.NetworkPeering) == 0 && len(dp.PrivateEndpoints) == 0 {
+		return nil
+	}
+
+	return b.runStep(ctx, op, stepCreateNetwork, func() error {
+		containerIDs := make([]string, 0, len(dp.NetworkContainers))
+		for _, c := range dp.NetworkContainers {
+			created, _, err := client.Containers.Create(ctx, gid, c)
+			if err != nil {
+				return err
+			}
+
+			comp.add(cleanupTask{Kind: cleanupDeleteContainer, GroupID: gid, Target: created.ID})
+			s.ContainerIDs = append(s.ContainerIDs, created.ID)
+			containerIDs = append(containerIDs, created.ID)
+		}
+
+		for i, p := range dp.NetworkPeering {
+			peer := *p
+			if peer.ContainerID == "" {
+				c := dp.PeerContainer(p)
+				if c < 0 {
+					return fmt.Errorf("no network container found for .networkPeering[%d]", i)
+				}
+				peer.ContainerID = containerIDs[c]
+			}
+
+			created, _, err := client.Peers.Create(ctx, gid, &peer)
+			if err != nil {
+				return err
+			}
+
+			comp.add(cleanupTask{Kind: cleanupDeletePeer, GroupID: gid, Target: created.ID})
+			s.PeerIDs = append(s.PeerIDs, created.ID)
+		}
+
+		for _, e := range dp.PrivateEndpoints {
+			created, _, err := client.PrivateEndpoints.Create(ctx, gid, e)
+			if err != nil {
+				return err
+			}
+
+			comp.add(cleanupTask{Kind: cleanupDeletePrivateEndpoint, GroupID: gid, Target: created.ID})
+			s.PrivateEndpointIDs = append(s.PrivateEndpointIDs, created.ID)
+		}
+
+		return nil
+	})
+}
+
+// networkCleanupTasks returns the tasks removing the network resources
+// created for an instance, in the order they have to be removed in.
+func networkCleanupTasks(s *serviceInstance, gid string) []cleanupTask {
+	tasks := []cleanupTask{}
+	for _, id := range s.PrivateEndpointIDs {
+		tasks = append(tasks, cleanupTask{Kind: cleanupDeletePrivateEndpoint, GroupID: gid, InstanceID: s.ID, Target: id})
+	}
+	for _, id := range s.PeerIDs {
+		tasks = append(tasks, cleanupTask{Kind: cleanupDeletePeer, GroupID: gid, InstanceID: s.ID, Target: id})
+	}
+	for _, id := range s.ContainerIDs {
+		tasks = append(tasks, cleanupTask{Kind: cleanupDeleteContainer, GroupID: gid, InstanceID: s.ID, Target: id})
+	}
+
+	return tasks
+}
@@ -0,0 +1,293 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+// The steps an instance operation can go through.
+const (
+	stepCreateProject        = "create-project"
+	stepApplyProjectSettings = "apply-project-settings"
+	stepCreateNetwork        = "create-network"
+	stepCreateCustomDBRoles  = "create-custom-db-roles"
+	stepCreateDatabaseUsers  = "create-database-users"
+	stepCreateIPWhitelist    = "create-ip-whitelist"
+	stepCreateAlertConfigs   = "create-alert-configurations"
+	stepCreateCluster        = "create-cluster"
+	stepUpdateCluster        = "update-cluster"
+	stepDeleteCluster        = "delete-cluster"
+	stepWaitForCluster       = "wait-for-cluster"
+	stepApplyBackupPolicy    = "apply-backup-policy"
+	stepRollback             = "rollback"
+	stepApplyDatabaseUsers   = "apply-database-users"
+	stepApplyIPWhitelist     = "apply-ip-whitelist"
+	stepApplyCustomDBRoles   = "apply-custom-db-roles"
+	stepApplyAlertConfigs    = "apply-alert-configurations"
+)
+
+// stepDescriptions are the human readable descriptions of each step,
+// returned to the platform by LastOperation.
+var stepDescriptions = map[string]string{
+	stepCreateProject:        "Creating Atlas project",
+	stepApplyProjectSettings: "Applying project settings, maintenance window and teams",
+	stepCreateNetwork:        "Configuring network containers, peering and private endpoints",
+	stepCreateCustomDBRoles:  "Creating custom database roles",
+	stepCreateDatabaseUsers:  "Creating database users",
+	stepCreateIPWhitelist:    "Configuring IP whitelist",
+	stepCreateAlertConfigs:   "Configuring alerts",
+	stepCreateCluster:        "Requesting cluster creation",
+	stepUpdateCluster:        "Requesting cluster update",
+	stepDeleteCluster:        "Requesting cluster deletion",
+	stepWaitForCluster:       "Waiting for Atlas to apply cluster changes",
+	stepApplyBackupPolicy:    "Applying backup policy",
+	stepRollback:             "Removing partially created resources",
+	stepApplyDatabaseUsers:   "Applying database user changes",
+	stepApplyIPWhitelist:     "Applying IP whitelist changes",
+	stepApplyCustomDBRoles:   "Applying custom database role changes",
+	stepApplyAlertConfigs:    "Applying alert changes",
+}
+
+// operation is the journal record of a Provision, Update or Deprovision
+// call. Its ID is handed to the platform as operation data so LastOperation
+// can look it up when polled.
+type operation struct {
+	ID         string                    `bson:"id" json:"id"`
+	InstanceID string                    `bson:"instanceID" json:"instanceID"`
+	Type       string                    `bson:"type" json:"type"`
+	State      domain.LastOperationState `bson:"state" json:"state"`
+	Steps      []*operationStep          `bson:"steps" json:"steps"`
+	Error      string                    `bson:"error,omitempty" json:"error,omitempty"`
+	Started    time.Time                 `bson:"started" json:"started"`
+	Updated    time.Time                 `bson:"updated" json:"updated"`
+
+	// BackupPolicy is applied to the BackupClusters in a final step once
+	// the clusters have reached their target state.
+	BackupPolicy   *mongodbatlas.CloudProviderSnapshotBackupPolicy `bson:"backupPolicy,omitempty" json:"backupPolicy,omitempty"`
+	BackupClusters []string                                        `bson:"backupClusters,omitempty" json:"backupClusters,omitempty"`
+}
+
+// operationStep is a single step of an operation.
+type operationStep struct {
+	Name     string                    `bson:"name" json:"name"`
+	State    domain.LastOperationState `bson:"state" json:"state"`
+	Detail   string                    `bson:"detail,omitempty" json:"detail,omitempty"`
+	Error    string                    `bson:"error,omitempty" json:"error,omitempty"`
+	Started  time.Time                 `bson:"started" json:"started"`
+	Finished time.Time                 `bson:"finished,omitempty" json:"finished,omitempty"`
+}
+
+func newOperation(instanceID string, opType string) *operation {
+	now := time.Now().UTC()
+	return &operation{
+		ID:         fmt.Sprintf("%s-%s", opType, uuid.New().String()),
+		InstanceID: instanceID,
+		Type:       opType,
+		State:      domain.InProgress,
+		Started:    now,
+		Updated:    now,
+	}
+}
+
+// begin starts a new step.
+func (o *operation) begin(name string) *operationStep {
+	s := &operationStep{
+		Name:    name,
+		State:   domain.InProgress,
+		Started: time.Now().UTC(),
+	}
+	o.Steps = append(o.Steps, s)
+	return s
+}
+
+// end finishes a step. A failed step fails the whole operation.
+func (o *operation) end(s *operationStep, err error) {
+	s.Finished = time.Now().UTC()
+	if err == nil {
+		s.State = domain.Succeeded
+		return
+	}
+
+	s.State = domain.Failed
+	s.Error = err.Error()
+	o.fail(err)
+}
+
+// current returns the last step started, if any.
+func (o *operation) current() *operationStep {
+	if len(o.Steps) == 0 {
+		return nil
+	}
+	return o.Steps[len(o.Steps)-1]
+}
+
+func (o *operation) succeed() {
+	o.State = domain.Succeeded
+}
+
+func (o *operation) fail(err error) {
+	o.State = domain.Failed
+	o.Error = err.Error()
+}
+
+// lastOperation converts the operation into an OSB last operation response.
+func (o *operation) lastOperation() domain.LastOperation {
+	return domain.LastOperation{
+		State:       o.State,
+		Description: o.description(),
+	}
+}
+
+func (o *operation) description() string {
+	opName := strings.Title(o.Type)
+
+	switch o.State {
+	case domain.Succeeded:
+		return fmt.Sprintf("%s completed", opName)
+
+	case domain.Failed:
+		for _, s := range o.Steps {
+			if s.State == domain.Failed {
+				return fmt.Sprintf("%s failed: %s: %s", opName, stepDescriptions[s.Name], s.Error)
+			}
+		}
+		return fmt.Sprintf("%s failed: %s", opName, o.Error)
+
+	default:
+		s := o.current()
+		if s == nil {
+			return fmt.Sprintf("%s in progress", opName)
+		}
+		if s.Detail != "" {
+			return fmt.Sprintf("%s (%s)", stepDescriptions[s.Name], s.Detail)
+		}
+		return stepDescriptions[s.Name]
+	}
+}
+
+// startOperation creates a new operation and writes it to the journal. It
+// returns nil if the broker runs without a state store.
+func (b *Broker) startOperation(ctx context.Context, instanceID string, opType string) (*operation, error) {
+	if b.state == nil {
+		return nil, nil
+	}
+
+	op := newOperation(instanceID, opType)
+	if err := b.state.Put(ctx, operationsCollection, op.ID, op); err != nil {
+		return nil, err
+	}
+
+	b.logger.Infow("Started operation", "instance_id", instanceID, "operation_id", op.ID)
+	return op, nil
+}
+
+// runStep runs f as a named step of the operation and records its outcome
+// in the journal.
+func (b *Broker) runStep(ctx context.Context, op *operation, name string, f func() error) error {
+	if op == nil {
+		return f()
+	}
+
+	s := op.begin(name)
+	b.saveOperation(ctx, op)
+
+	err := f()
+	op.end(s, err)
+	b.saveOperation(ctx, op)
+
+	return err
+}
+
+// saveOperation writes the operation to the journal. Failures are only
+// logged as the operation itself has already taken place in Atlas.
+func (b *Broker) saveOperation(ctx context.Context, op *operation) {
+	if op == nil {
+		return
+	}
+
+	op.Updated = time.Now().UTC()
+	if err := b.state.Put(ctx, operationsCollection, op.ID, op); err != nil {
+		b.logger.Errorw("Failed to save operation", "error", err, "instance_id", op.InstanceID, "operation_id", op.ID)
+	}
+}
+
+// getOperation looks up the operation referenced by the operation data of a
+// poll. It returns nil if there is no journal entry, for example for
+// operations started by an older broker version.
+func (b *Broker) getOperation(ctx context.Context, operationID string) (*operation, error) {
+	if b.state == nil || operationID == "" {
+		return nil, nil
+	}
+
+	op := operation{}
+	err := b.state.Get(ctx, operationsCollection, operationID, &op)
+	if err == ErrStateNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &op, nil
+}
+
+// operationData returns the operation data handed to the platform.
+func operationData(op *operation, opType string) string {
+	if op == nil {
+		return opType
+	}
+	return op.ID
+}
+
+// failOperationOnError marks the operation as failed if the calling OSB
+// method returns an error outside of any step. It is meant to be deferred.
+func (b *Broker) failOperationOnError(ctx context.Context, op *operation, err *error) {
+	if op == nil || *err == nil || op.State != domain.InProgress {
+		return
+	}
+
+	op.fail(*err)
+	b.saveOperation(ctx, op)
+}
+
+// waitForCluster starts the final step of an operation, which completes
+// once Atlas reports the cluster in its target state.
+func (b *Broker) waitForCluster(ctx context.Context, op *operation) {
+	if op == nil {
+		return
+	}
+
+	op.begin(stepWaitForCluster)
+	b.saveOperation(ctx, op)
+}
+
+// updateWaitForCluster records the cluster state observed by LastOperation
+// in the final step of the operation.
+func (b *Broker) updateWaitForCluster(ctx context.Context, op *operation, state domain.LastOperationState, detail string) {
+	s := op.current()
+	if s == nil || s.Name != stepWaitForCluster {
+		return
+	}
+
+	s.Detail = detail
+
+	switch state {
+	case domain.Succeeded:
+		op.end(s, nil)
+
+		// Operations with a backup policy continue with applying it.
+		if op.BackupPolicy == nil {
+			op.succeed()
+		}
+	case domain.Failed:
+		op.end(s, fmt.Errorf("cluster is in state %q", detail))
+	}
+
+	b.saveOperation(ctx, op)
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// The requests a plan can define a parameter schema for.
+const (
+	schemaCreate = "create"
+	schemaUpdate = "update"
+	schemaBind   = "bind"
+)
+
+// validateParameters checks the parameters of a request against the schema
+// the plan publishes for it. Requests which don't conform are rejected with
+// 400 Bad Request before anything is sent to Atlas.
+func (b *Broker) validateParameters(planID string, action string, raw json.RawMessage) error {
+	plan, ok := b.getCatalog().plans[planID]
+	if !ok || plan.Schemas == nil {
+		return nil
+	}
+
+	var schema dynamicplans.Schema
+	switch action {
+	case schemaCreate:
+		schema = plan.Schemas.Instance.Create.Parameters
+	case schemaUpdate:
+		schema = plan.Schemas.Instance.Update.Parameters
+	case schemaBind:
+		schema = plan.Schemas.Binding.Create.Parameters
+	}
+
+	if len(schema) == 0 {
+		return nil
+	}
+
+	var params interface{} = map[string]interface{}{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return apiresponses.NewFailureResponse(fmt.Errorf("invalid parameters: %v", err), http.StatusBadRequest, "validate-parameters")
+		}
+	}
+
+	if err := schema.Validate(params); err != nil {
+		b.logger.Infow("Rejected request parameters", "plan_id", planID, "action", action, "error", err)
+		return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "validate-parameters")
+	}
+
+	return nil
+}
+
+// checkOverrides rejects requests whose parameters set plan fields the
+// rendered plan doesn't list as overridable with 400 Bad Request.
+func (b *Broker) checkOverrides(instanceID string, planID string, planContext dynamicplans.Context, raw json.RawMessage) error {
+	if b.mode != DynamicPlans || planID == "" || len(raw) == 0 {
+		return nil
+	}
+
+	var params map[string]interface{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return apiresponses.NewFailureResponse(fmt.Errorf("invalid parameters: %v", err), http.StatusBadRequest, "validate-parameters")
+	}
+
+	dp, err := b.parsePlan(instanceID, planContext, planID)
+	if err != nil {
+		return err
+	}
+
+	if err := dp.CheckOverrides(params); err != nil {
+		b.logger.Infow("Rejected request parameters", "plan_id", planID, "error", err)
+		return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "locked-plan-fields")
+	}
+
+	return nil
+}
+
+// contextValues converts a plan context into the shape produced by decoding
+// JSON, which is what plan overrides are matched against.
+func contextValues(ctx dynamicplans.Context) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if len(ctx) == 0 {
+		return values, nil
+	}
+
+	pb, err := json.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, json.Unmarshal(pb, &values)
+}
@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+)
+
+// createCustomDBRoles creates the custom database roles of a plan. They are
+// created before the database users so users can be granted them.
+func (b *Broker) createCustomDBRoles(ctx context.Context, op *operation, comp *compensationLog, client *mongodbatlas.Client, gid string, s *serviceInstance, roles []*mongodbatlas.CustomDBRole) error {
+	if len(roles) == 0 {
+		return nil
+	}
+
+	return b.runStep(ctx, op, stepCreateCustomDBRoles, func() error {
+		for _, r := range roles {
+			_, _, err := client.CustomDBRoles.Create(ctx, gid, r)
+			if err != nil {
+				return err
+			}
+
+			comp.add(cleanupTask{Kind: cleanupDeleteCustomDBRole, GroupID: gid, Target: r.RoleName})
+			s.CustomDBRoles = append(s.CustomDBRoles, r.RoleName)
+		}
+		return nil
+	})
+}
+
+// createAlertConfigurations creates the alert configurations of a plan.
+func (b *Broker) createAlertConfigurations(ctx context.Context, op *operation, comp *compensationLog, client *mongodbatlas.Client, gid string, s *serviceInstance, alerts []*mongodbatlas.AlertConfiguration) error {
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	return b.runStep(ctx, op, stepCreateAlertConfigs, func() error {
+		for _, a := range alerts {
+			created, _, err := client.AlertConfigurations.Create(ctx, gid, a)
+			if err != nil {
+				return err
+			}
+
+			comp.add(cleanupTask{Kind: cleanupDeleteAlertConfig, GroupID: gid, Target: created.ID})
+			s.AlertConfigIDs = append(s.AlertConfigIDs, created.ID)
+		}
+		return nil
+	})
+}
+
+// syncCustomDBRoles brings the custom roles created for an instance in line
+// with its plan: roles in the plan are created or updated, and roles created
+// from an earlier version of the plan but no longer in it are removed. Roles
+// created outside the broker are left alone.
+func (b *Broker) syncCustomDBRoles(ctx context.Context, op *operation, client *mongodbatlas.Client, gid string, s *serviceInstance, roles []*mongodbatlas.CustomDBRole) error {
+	if len(roles) == 0 && len(s.CustomDBRoles) == 0 {
+		return nil
+	}
+
+	return b.runStep(ctx, op, stepApplyCustomDBRoles, func() error {
+		managed := map[string]bool{}
+		for _, name := range s.CustomDBRoles {
+			managed[name] = true
+		}
+
+		names := []string{}
+		for _, r := range roles {
+			if managed[r.RoleName] {
+				// The role name is part of the path and can't be changed.
+				update := *r
+				update.RoleName = ""
+				if _, _, err := client.CustomDBRoles.Update(ctx, gid, r.RoleName, &update); err != nil {
+					return err
+				}
+			} else {
+				if _, _, err := client.CustomDBRoles.Create(ctx, gid, r); err != nil {
+					return err
+				}
+
+				// Recorded right away, so the role is removed later on
+				// even if a following step fails.
+				s.CustomDBRoles = append(s.CustomDBRoles, r.RoleName)
+			}
+
+			delete(managed, r.RoleName)
+			names = append(names, r.RoleName)
+		}
+
+		for _, name := range s.CustomDBRoles {
+			if !managed[name] {
+				continue
+			}
+
+			r, err := client.CustomDBRoles.Delete(ctx, gid, name)
+			if err != nil && (r == nil || r.StatusCode != http.StatusNotFound) {
+				return err
+			}
+		}
+
+		s.CustomDBRoles = names
+		return nil
+	})
+}
+
+// syncAlertConfigurations brings the alert configurations created for an
+// instance in line with its plan. Alerts are matched with the plan by
+// position: existing ones are updated, extra plan alerts are created and
+// alerts no longer in the plan are removed. The default alerts Atlas creates
+// for every project are left alone.
+func (b *Broker) syncAlertConfigurations(ctx context.Context, op *operation, client *mongodbatlas.Client, gid string, s *serviceInstance, alerts []*mongodbatlas.AlertConfiguration) error {
+	if len(alerts) == 0 && len(s.AlertConfigIDs) == 0 {
+		return nil
+	}
+
+	return b.runStep(ctx, op, stepApplyAlertConfigs, func() error {
+		ids := []string{}
+		for i, a := range alerts {
+			if i < len(s.AlertConfigIDs) {
+				id := s.AlertConfigIDs[i]
+				if _, _, err := client.AlertConfigurations.Update(ctx, gid, id, a); err != nil {
+					return err
+				}
+				ids = append(ids, id)
+				continue
+			}
+
+			created, _, err := client.AlertConfigurations.Create(ctx, gid, a)
+			if err != nil {
+				return err
+			}
+
+			// Alerts are only created past the recorded ones, so the new
+			// ID is recorded right away at the alert's position.
+			s.AlertConfigIDs = append(s.AlertConfigIDs, created.ID)
+			ids = append(ids, created.ID)
+		}
+
+		for i := len(alerts); i < len(s.AlertConfigIDs); i++ {
+			r, err := client.AlertConfigurations.Delete(ctx, gid, s.AlertConfigIDs[i])
+			if err != nil && (r == nil || r.StatusCode != http.StatusNotFound) {
+				return err
+			}
+		}
+
+		s.AlertConfigIDs = ids
+		return nil
+	})
+}
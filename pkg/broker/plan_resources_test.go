@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestSyncCustomDBRoles(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, err := mongodbatlas.New(server.Client(), mongodbatlas.SetBaseURL(server.URL+"/"))
+	assert.NoError(t, err)
+
+	b := &Broker{logger: zap.NewNop().Sugar()}
+	s := &serviceInstance{CustomDBRoles: []string{"kept", "dropped"}}
+	roles := []*mongodbatlas.CustomDBRole{
+		{RoleName: "kept"},
+		{RoleName: "added"},
+	}
+
+	err = b.syncCustomDBRoles(context.Background(), nil, client, "group", s, roles)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kept", "added"}, s.CustomDBRoles)
+	assert.Equal(t, []string{
+		"PATCH /groups/group/customDBRoles/roles/kept",
+		"POST /groups/group/customDBRoles/roles",
+		"DELETE /groups/group/customDBRoles/roles/dropped",
+	}, requests)
+}
+
+func TestSyncAlertConfigurationsRecordsCreatedAlerts(t *testing.T) {
+	created := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			created++
+			if created > 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"errorCode": "UNEXPECTED_ERROR"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"id": "new"}`))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, err := mongodbatlas.New(server.Client(), mongodbatlas.SetBaseURL(server.URL+"/"))
+	assert.NoError(t, err)
+
+	b := &Broker{logger: zap.NewNop().Sugar()}
+	s := &serviceInstance{AlertConfigIDs: []string{"existing"}}
+	alerts := []*mongodbatlas.AlertConfiguration{
+		{EventTypeName: "a"},
+		{EventTypeName: "b"},
+		{EventTypeName: "c"},
+	}
+
+	// The alert created before the failure is recorded.
+	err = b.syncAlertConfigurations(context.Background(), nil, client, "group", s, alerts)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"existing", "new"}, s.AlertConfigIDs)
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+)
+
+// projectSettingsPath is the Atlas API path of a project's settings.
+const projectSettingsPath = "groups/%s/settings"
+
+// syncProjectSettings applies the project settings, maintenance window and
+// teams of a plan to the project of an instance. It runs right after the
+// project is created and again on every update, so projects don't drift from
+// the plan. Teams dropped from the plan are removed from the project; teams
+// added outside the broker are left alone.
+func (b *Broker) syncProjectSettings(ctx context.Context, op *operation, client *mongodbatlas.Client, gid string, s *serviceInstance, dp dynamicplans.Plan) error {
+	if dp.ProjectSettings == nil && dp.MaintenanceWindow == nil && len(dp.Teams) == 0 && len(s.TeamIDs) == 0 {
+		return nil
+	}
+
+	return b.runStep(ctx, op, stepApplyProjectSettings, func() error {
+		if dp.ProjectSettings != nil {
+			req, err := client.NewRequest(ctx, http.MethodPatch, fmt.Sprintf(projectSettingsPath, gid), dp.ProjectSettings)
+			if err != nil {
+				return err
+			}
+
+			if _, err := client.Do(ctx, req, nil); err != nil {
+				return err
+			}
+		}
+
+		if dp.MaintenanceWindow != nil {
+			if _, err := client.MaintenanceWindows.Update(ctx, gid, dp.MaintenanceWindow); err != nil {
+				return err
+			}
+		}
+
+		return syncProjectTeams(ctx, client, gid, s, dp.Teams)
+	})
+}
+
+// syncProjectTeams adds the teams of a plan to a project, updates the roles
+// of teams added earlier and removes teams no longer in the plan.
+func syncProjectTeams(ctx context.Context, client *mongodbatlas.Client, gid string, s *serviceInstance, teams []*mongodbatlas.ProjectTeam) error {
+	managed := map[string]bool{}
+	for _, id := range s.TeamIDs {
+		managed[id] = true
+	}
+
+	added := []*mongodbatlas.ProjectTeam{}
+	ids := []string{}
+	for _, t := range teams {
+		if managed[t.TeamID] {
+			_, _, err := client.Teams.UpdateTeamRoles(ctx, gid, t.TeamID, &mongodbatlas.TeamUpdateRoles{RoleNames: t.RoleNames})
+			if err != nil {
+				return err
+			}
+		} else {
+			added = append(added, t)
+		}
+
+		delete(managed, t.TeamID)
+		ids = append(ids, t.TeamID)
+	}
+
+	if len(added) > 0 {
+		if _, _, err := client.Projects.AddTeamsToProject(ctx, gid, added); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range s.TeamIDs {
+		if !managed[id] {
+			continue
+		}
+
+		r, err := client.Teams.RemoveTeamFromProject(ctx, gid, id)
+		if err != nil && (r == nil || r.StatusCode != http.StatusNotFound) {
+			return err
+		}
+	}
+
+	s.TeamIDs = ids
+	return nil
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestSyncProjectSettings(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, err := mongodbatlas.New(server.Client(), mongodbatlas.SetBaseURL(server.URL+"/"))
+	assert.NoError(t, err)
+
+	enabled := false
+	hour := 4
+	dp := dynamicplans.Plan{
+		ProjectSettings:   &dynamicplans.ProjectSettings{IsDataExplorerEnabled: &enabled},
+		MaintenanceWindow: &mongodbatlas.MaintenanceWindow{DayOfWeek: mongodbatlas.Sunday, HourOfDay: &hour},
+		Teams: []*mongodbatlas.ProjectTeam{
+			{TeamID: "kept", RoleNames: []string{"GROUP_READ_ONLY"}},
+			{TeamID: "added", RoleNames: []string{"GROUP_OWNER"}},
+		},
+	}
+
+	b := &Broker{logger: zap.NewNop().Sugar()}
+	s := &serviceInstance{TeamIDs: []string{"kept", "dropped"}}
+
+	err = b.syncProjectSettings(context.Background(), nil, client, "group", s, dp)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kept", "added"}, s.TeamIDs)
+	assert.Equal(t, []string{
+		"PATCH /groups/group/settings",
+		"PATCH /groups/group/maintenanceWindow",
+		"PATCH /groups/group/teams/kept",
+		"POST /groups/group/teams",
+		"DELETE /groups/group/teams/dropped",
+	}, requests)
+}
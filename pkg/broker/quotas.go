@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// Quotas are the instance quotas configured for the broker. The quota at the
+// top level counts the instances of all plans, the ones in Plans only the
+// instances of the plan with the given name. Plan quotas apply on top of the
+// quota the plan template declares itself.
+type Quotas struct {
+	dynamicplans.Quota
+	Plans map[string]dynamicplans.Quota `json:"plans,omitempty"`
+}
+
+// ReadQuotasFile reads the broker's instance quotas from a JSON file.
+func ReadQuotasFile(path string) (*Quotas, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := &Quotas{}
+	if err := json.Unmarshal(bytes, quotas); err != nil {
+		return nil, err
+	}
+
+	if err := checkQuota(quotas.Quota); err != nil {
+		return nil, err
+	}
+	for name, q := range quotas.Plans {
+		if err := checkQuota(q); err != nil {
+			return nil, fmt.Errorf("plan %q: %v", name, err)
+		}
+	}
+
+	return quotas, nil
+}
+
+func checkQuota(q dynamicplans.Quota) error {
+	if q.MaxInstances < 0 || q.MaxInstancesPerOrg < 0 || q.MaxInstancesPerNamespace < 0 || q.MaxInstancesPerCFOrg < 0 {
+		return fmt.Errorf("quota limits must not be negative")
+	}
+	return nil
+}
+
+// tenant is who an instance is provisioned for: the Atlas org of its plan
+// and the Kubernetes namespace or Cloud Foundry space and org it was
+// requested from.
+type tenant struct {
+	OrgID     string
+	Namespace string
+	CFOrg     string
+}
+
+// platformContext holds the fields of the OSB platform context which
+// identify the tenant on Kubernetes and Cloud Foundry.
+type platformContext struct {
+	Namespace string `json:"namespace"`
+	SpaceGUID string `json:"space_guid"`
+	OrgGUID   string `json:"organization_guid"`
+}
+
+// checkQuotas checks that provisioning an instance of a plan doesn't exceed
+// the quotas of the broker or the plan, counting the instances in the state
+// store. Requests which would are rejected with 422 Unprocessable Entity. It
+// returns the tenant of the new instance, to be recorded with it.
+//
+// Provision requests arriving at the same time are counted separately, so
+// they can exceed a quota by the number of concurrent requests.
+func (b *Broker) checkQuotas(ctx context.Context, instanceID string, planID string, planContext dynamicplans.Context, rawContext json.RawMessage) (t tenant, err error) {
+	pc := platformContext{}
+	if len(rawContext) > 0 {
+		if err = json.Unmarshal(rawContext, &pc); err != nil {
+			return
+		}
+	}
+
+	t.Namespace = pc.Namespace
+	if pc.SpaceGUID != "" {
+		t.Namespace = pc.SpaceGUID
+	}
+	t.CFOrg = pc.OrgGUID
+
+	if b.mode != DynamicPlans {
+		return
+	}
+
+	dp, err := b.parsePlan(instanceID, planContext, planID)
+	if err != nil {
+		return
+	}
+
+	if dp.Project != nil {
+		t.OrgID = dp.Project.OrgID
+	}
+
+	type scope struct {
+		name   string
+		planID string
+		quota  dynamicplans.Quota
+	}
+
+	scopes := []scope{}
+	if b.quotas != nil {
+		scopes = append(scopes, scope{name: "the broker", quota: b.quotas.Quota})
+		if q, ok := b.quotas.Plans[dp.Name]; ok {
+			scopes = append(scopes, scope{name: fmt.Sprintf("plan %q", dp.Name), planID: planID, quota: q})
+		}
+	}
+	if dp.Quota != nil {
+		scopes = append(scopes, scope{name: fmt.Sprintf("plan %q", dp.Name), planID: planID, quota: *dp.Quota})
+	}
+
+	if len(scopes) == 0 || b.state == nil {
+		return
+	}
+
+	instances, err := b.otherInstances(ctx, instanceID)
+	if err != nil {
+		return
+	}
+
+	for _, sc := range scopes {
+		var total, org, namespace, cfOrg int
+		for _, s := range instances {
+			if sc.planID != "" && s.PlanID != sc.planID {
+				continue
+			}
+
+			total++
+			if t.OrgID != "" && s.OrgID == t.OrgID {
+				org++
+			}
+			if t.Namespace != "" && s.Namespace == t.Namespace {
+				namespace++
+			}
+			if t.CFOrg != "" && s.CFOrg == t.CFOrg {
+				cfOrg++
+			}
+		}
+
+		q := sc.quota
+		var msg string
+		switch {
+		case exceeds(q.MaxInstances, total):
+			msg = fmt.Sprintf("%s allows at most %d instances", sc.name, q.MaxInstances)
+		case t.OrgID != "" && exceeds(q.MaxInstancesPerOrg, org):
+			msg = fmt.Sprintf("%s allows at most %d instances in Atlas org %s", sc.name, q.MaxInstancesPerOrg, t.OrgID)
+		case t.Namespace != "" && exceeds(q.MaxInstancesPerNamespace, namespace):
+			msg = fmt.Sprintf("%s allows at most %d instances in namespace %s", sc.name, q.MaxInstancesPerNamespace, t.Namespace)
+		case t.CFOrg != "" && exceeds(q.MaxInstancesPerCFOrg, cfOrg):
+			msg = fmt.Sprintf("%s allows at most %d instances in Cloud Foundry org %s", sc.name, q.MaxInstancesPerCFOrg, t.CFOrg)
+		default:
+			continue
+		}
+
+		b.logger.Infow("Rejected provisioning over quota", "instance_id", instanceID, "plan_id", planID, "quota", msg)
+		err = apiresponses.NewFailureResponse(fmt.Errorf("instance quota exceeded: %s", msg), http.StatusUnprocessableEntity, "quota-exceeded")
+		return
+	}
+
+	return
+}
+
+// exceeds reports whether another instance would exceed a limit, given the
+// number of existing instances. Limits of zero are not enforced.
+func exceeds(limit int, existing int) bool {
+	return limit > 0 && existing >= limit
+}
+
+// otherInstances loads every instance in the state store except the one
+// with the given ID.
+func (b *Broker) otherInstances(ctx context.Context, instanceID string) ([]*serviceInstance, error) {
+	ids, err := b.state.IDs(ctx, instancesCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []*serviceInstance{}
+	for _, id := range ids {
+		if id == instanceID {
+			continue
+		}
+
+		s, err := b.getInstance(ctx, id)
+		if err == ErrStateNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, s)
+	}
+
+	return instances, nil
+}
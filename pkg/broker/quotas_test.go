@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCheckQuotas(t *testing.T) {
+	dir := useTestTemplateDir(t)
+
+	quota := "project:\n  orgId: org\nquota:\n  maxInstancesPerNamespace: 1\n"
+	writeTestTemplate(t, dir, "small", quota+fmt.Sprintf(testPlanTemplate, "small"))
+
+	ctx := context.Background()
+	quotas := &Quotas{Quota: dynamicplans.Quota{MaxInstancesPerOrg: 2}}
+	b := New(zap.NewNop().Sugar(), nil, "", nil, quotas, NewMemoryStateStore(), DynamicPlans)
+
+	var planID string
+	for id := range b.getCatalog().plans {
+		planID = id
+	}
+
+	provision := func(instanceID string, namespace string) error {
+		raw := json.RawMessage(`{"platform":"kubernetes","namespace":"` + namespace + `"}`)
+		owner, err := b.checkQuotas(ctx, instanceID, planID, dynamicplans.Context{}, raw)
+		if err != nil {
+			return err
+		}
+
+		assert.Equal(t, tenant{OrgID: "org", Namespace: namespace}, owner)
+		return b.state.Put(ctx, instancesCollection, instanceID, serviceInstance{
+			ID:                     instanceID,
+			GetInstanceDetailsSpec: domain.GetInstanceDetailsSpec{PlanID: planID},
+			OrgID:                  owner.OrgID,
+			Namespace:              owner.Namespace,
+		})
+	}
+
+	assert.NoError(t, provision("a", "team-a"))
+
+	err := provision("b", "team-a")
+	if assert.Error(t, err) {
+		assert.Equal(t, 422, err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil))
+		assert.Contains(t, err.Error(), `plan "small" allows at most 1 instances in namespace team-a`)
+	}
+
+	// Retried requests don't count the instance against itself.
+	assert.NoError(t, provision("a", "team-a"))
+
+	assert.NoError(t, provision("b", "team-b"))
+	err = provision("c", "team-c")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the broker allows at most 2 instances in Atlas org org")
+	}
+}
@@ -0,0 +1,433 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mongodb/go-client-mongodb-atlas/mongodbatlas"
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+// The kinds of mismatches found by Reconcile.
+const (
+	FindingStaleInstance   = "stale-instance"
+	FindingOrphanedCluster = "orphaned-cluster"
+	FindingOrphanedProject = "orphaned-project"
+)
+
+// reconcileGracePeriod protects projects and clusters created by a
+// provision which is still in flight from being removed as orphans.
+const reconcileGracePeriod = time.Hour
+
+// managedResource records a project or cluster the broker created. Fix mode
+// only ever deletes resources recorded this way, so projects and clusters
+// created outside the broker in the orgs it manages are left alone.
+type managedResource struct {
+	// ID is the group ID of a project, or "<group ID>/<cluster name>".
+	ID          string    `bson:"id" json:"id"`
+	GroupID     string    `bson:"groupID" json:"groupID"`
+	ClusterName string    `bson:"clusterName,omitempty" json:"clusterName,omitempty"`
+	InstanceID  string    `bson:"instanceID,omitempty" json:"instanceID,omitempty"`
+	Created     time.Time `bson:"created" json:"created"`
+}
+
+func managedID(gid string, clusterName string) string {
+	if clusterName == "" {
+		return gid
+	}
+	return gid + "/" + clusterName
+}
+
+// recordManaged records a project, or a cluster if a name is given, as
+// created by the broker. Failures are logged, the resource then merely
+// can't be removed by the reconciler.
+func (b *Broker) recordManaged(ctx context.Context, instanceID string, gid string, clusterName string) {
+	if b.state == nil {
+		return
+	}
+
+	r := managedResource{
+		ID:          managedID(gid, clusterName),
+		GroupID:     gid,
+		ClusterName: clusterName,
+		InstanceID:  instanceID,
+		Created:     time.Now().UTC(),
+	}
+
+	if err := b.state.Put(ctx, managedCollection, r.ID, r); err != nil {
+		b.logger.Errorw("Failed to record managed resource", "error", err, "group_id", gid, "cluster_name", clusterName)
+	}
+}
+
+// managedResources loads the records of the projects and clusters the
+// broker created, by ID.
+func (b *Broker) managedResources(ctx context.Context) (map[string]managedResource, error) {
+	ids, err := b.state.IDs(ctx, managedCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := map[string]managedResource{}
+	for _, id := range ids {
+		r := managedResource{}
+		if err := b.state.Get(ctx, managedCollection, id, &r); err != nil {
+			if err == ErrStateNotFound {
+				continue
+			}
+			return nil, err
+		}
+		managed[id] = r
+	}
+
+	return managed, nil
+}
+
+// ReconcileFinding describes a mismatch between the state store and what
+// the configured API keys can see in Atlas.
+type ReconcileFinding struct {
+	Kind        string `json:"kind"`
+	InstanceID  string `json:"instanceID,omitempty"`
+	GroupID     string `json:"groupID"`
+	ClusterName string `json:"clusterName,omitempty"`
+	Reason      string `json:"reason"`
+
+	// Fixable is set if fix mode is allowed to act on the finding. Only
+	// projects and clusters the broker recorded as created by itself, and
+	// only once they are older than reconcileGracePeriod, are ever deleted.
+	Fixable  bool   `json:"fixable"`
+	Fixed    bool   `json:"fixed"`
+	FixError string `json:"fixError,omitempty"`
+}
+
+// instanceRef is the Atlas location of a service instance.
+type instanceRef struct {
+	instanceID  string
+	groupID     string
+	clusterName string
+	// Only the primary cluster decides whether an instance is stale.
+	primary bool
+	// provisioning is set for instances whose clusters may not have been
+	// requested yet, which are never reported as stale.
+	provisioning bool
+}
+
+// Reconcile compares the instance records in the state store with the
+// projects and clusters visible in Atlas. It reports instance records
+// pointing at resources which no longer exist, clusters which no instance
+// refers to, and projects created by the broker which no instance refers to.
+// In fix mode stale records are removed, orphaned clusters the broker
+// created are deleted and orphaned projects are queued for deletion.
+func (b *Broker) Reconcile(ctx context.Context, fix bool) ([]ReconcileFinding, error) {
+	if b.state == nil {
+		return nil, errors.New("reconciliation requires a state store")
+	}
+
+	refs, err := b.instanceRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	referencedProjects := map[string]bool{}
+	referencedClusters := map[string]bool{}
+	for _, r := range refs {
+		referencedProjects[r.groupID] = true
+		referencedClusters[r.groupID+"/"+r.clusterName] = true
+	}
+
+	queued, err := b.queuedProjectDeletions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	managed, err := b.managedResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	findings := []ReconcileFinding{}
+	missingProjects := map[string]bool{}
+	inspectedProjects := map[string]bool{}
+	existingClusters := map[string]bool{}
+
+	for gid := range b.credentials.ProjectKeys() {
+		client, err := b.projectClient(gid)
+		if err != nil {
+			return nil, err
+		}
+
+		_, r, err := client.Projects.GetOneProject(ctx, gid)
+		if err != nil {
+			if r != nil && r.StatusCode == http.StatusNotFound {
+				missingProjects[gid] = true
+				continue
+			}
+			b.logger.Warnw("Cannot inspect project", "error", err, "group_id", gid)
+			continue
+		}
+
+		clusters, _, err := client.Clusters.List(ctx, gid, nil)
+		if err != nil {
+			b.logger.Warnw("Cannot list clusters", "error", err, "group_id", gid)
+			continue
+		}
+		inspectedProjects[gid] = true
+
+		for _, c := range clusters {
+			if c.StateName == "DELETING" || c.StateName == "DELETED" {
+				continue
+			}
+
+			existingClusters[gid+"/"+c.Name] = true
+			if referencedClusters[gid+"/"+c.Name] {
+				continue
+			}
+
+			f := ReconcileFinding{
+				Kind:        FindingOrphanedCluster,
+				GroupID:     gid,
+				ClusterName: c.Name,
+				Reason:      "cluster is not referenced by any instance",
+			}
+
+			rec, ok := managed[managedID(gid, c.Name)]
+			switch {
+			case !ok:
+				f.Reason += " and was not created by the broker"
+			case c.StateName == "CREATING" || !olderThan(rec.Created, reconcileGracePeriod):
+				f.Reason += " but was created recently"
+			default:
+				f.Fixable = true
+			}
+
+			findings = append(findings, f)
+		}
+
+		rec, ok := managed[managedID(gid, "")]
+		if ok && !referencedProjects[gid] && !queued[gid] {
+			findings = append(findings, ReconcileFinding{
+				Kind:    FindingOrphanedProject,
+				GroupID: gid,
+				Reason:  "project was created by the broker but is not referenced by any instance",
+				Fixable: olderThan(rec.Created, reconcileGracePeriod),
+			})
+		}
+	}
+
+	for _, r := range refs {
+		if !r.primary || r.provisioning {
+			continue
+		}
+
+		f := ReconcileFinding{
+			Kind:        FindingStaleInstance,
+			InstanceID:  r.instanceID,
+			GroupID:     r.groupID,
+			ClusterName: r.clusterName,
+		}
+
+		_, hasCredentials := b.credentials.Project(r.groupID)
+
+		switch {
+		case !hasCredentials:
+			f.Reason = "no API key can see the project"
+		case missingProjects[r.groupID]:
+			f.Reason = "project no longer exists"
+			f.Fixable = true
+		case inspectedProjects[r.groupID] && !existingClusters[r.groupID+"/"+r.clusterName]:
+			f.Reason = "cluster no longer exists"
+			f.Fixable = true
+		default:
+			continue
+		}
+
+		findings = append(findings, f)
+	}
+
+	if fix {
+		for i := range findings {
+			b.fixFinding(ctx, &findings[i])
+		}
+
+		// Records of resources which are gone are no longer needed.
+		for id, rec := range managed {
+			gone := missingProjects[rec.GroupID] ||
+				rec.ClusterName != "" && inspectedProjects[rec.GroupID] && !existingClusters[id]
+			if !gone {
+				continue
+			}
+
+			if err := b.state.Delete(ctx, managedCollection, id); err != nil {
+				b.logger.Errorw("Failed to remove managed resource record", "error", err, "group_id", rec.GroupID, "cluster_name", rec.ClusterName)
+			}
+		}
+	}
+
+	return findings, nil
+}
+
+// RunReconciler runs Reconcile periodically until the context is cancelled
+// and logs every finding.
+func (b *Broker) RunReconciler(ctx context.Context, interval time.Duration, fix bool) {
+	b.logger.Infow("Starting reconciler", "interval", interval.String(), "fix", fix)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.logger.Info("Stopping reconciler")
+			return
+		case <-ticker.C:
+		}
+
+		findings, err := b.Reconcile(ctx, fix)
+		if err != nil {
+			b.logger.Errorw("Reconciliation failed", "error", err)
+			continue
+		}
+
+		for _, f := range findings {
+			b.logger.Warnw("Reconciliation finding", "finding", f)
+		}
+		b.logger.Infow("Reconciliation complete", "findings", len(findings))
+	}
+}
+
+// instanceRefs loads the Atlas location of every instance in the state
+// store.
+func (b *Broker) instanceRefs(ctx context.Context) ([]instanceRef, error) {
+	ids, err := b.state.IDs(ctx, instancesCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []instanceRef{}
+	for _, id := range ids {
+		s, err := b.getInstanceState(ctx, id)
+		if err == ErrStateNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		gid, _ := s["groupID"].(string)
+		name, _ := s["clusterName"].(string)
+
+		// Instances are recorded before their cluster has been requested.
+		if name == "" {
+			continue
+		}
+
+		names, err := b.getClusterNamesByInstanceID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		provisioning, err := b.isProvisioning(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, n := range names {
+			refs = append(refs, instanceRef{
+				instanceID:   id,
+				groupID:      gid,
+				clusterName:  n,
+				primary:      i == 0,
+				provisioning: provisioning,
+			})
+		}
+	}
+
+	return refs, nil
+}
+
+// isProvisioning reports whether an instance may still be in the middle of
+// being provisioned: its provision operation is in progress, or its record
+// is younger than reconcileGracePeriod. The record is written before the
+// clusters are requested, so until then they can't be found in Atlas.
+func (b *Broker) isProvisioning(ctx context.Context, instanceID string) (bool, error) {
+	s, err := b.getInstance(ctx, instanceID)
+	if err != nil {
+		return false, err
+	}
+
+	if !s.Created.IsZero() && !olderThan(s.Created, reconcileGracePeriod) {
+		return true, nil
+	}
+
+	op, err := b.getOperation(ctx, s.OperationID)
+	if err != nil {
+		return false, err
+	}
+
+	return op != nil && op.Type == OperationProvision && op.State == domain.InProgress, nil
+}
+
+// queuedProjectDeletions returns the projects which already have a pending
+// deletion task.
+func (b *Broker) queuedProjectDeletions(ctx context.Context) (map[string]bool, error) {
+	ids, err := b.state.IDs(ctx, cleanupTasksCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := map[string]bool{}
+	for _, id := range ids {
+		t := cleanupTask{}
+		if err := b.state.Get(ctx, cleanupTasksCollection, id, &t); err != nil {
+			continue
+		}
+
+		if t.Kind == cleanupDeleteProject && t.State == cleanupStatePending {
+			queued[t.GroupID] = true
+		}
+	}
+
+	return queued, nil
+}
+
+// fixFinding resolves a fixable finding.
+func (b *Broker) fixFinding(ctx context.Context, f *ReconcileFinding) {
+	if !f.Fixable {
+		return
+	}
+
+	var err error
+	switch f.Kind {
+	case FindingStaleInstance:
+		err = b.state.Delete(ctx, instancesCollection, f.InstanceID)
+
+	case FindingOrphanedCluster:
+		var client *mongodbatlas.Client
+		client, err = b.projectClient(f.GroupID)
+		if err == nil {
+			_, err = client.Clusters.Delete(ctx, f.GroupID, f.ClusterName)
+		}
+
+	case FindingOrphanedProject:
+		b.enqueueCleanup(ctx, cleanupTask{
+			Kind:    cleanupDeleteProject,
+			GroupID: f.GroupID,
+		}, 0)
+	}
+
+	if err != nil {
+		f.FixError = err.Error()
+		b.logger.Errorw("Failed to fix reconciliation finding", "error", err, "finding", f)
+		return
+	}
+
+	f.Fixed = true
+	b.logger.Infow("Fixed reconciliation finding", "finding", f)
+}
+
+// olderThan reports whether a resource was recorded longer ago than the
+// given duration.
+func olderThan(created time.Time, d time.Duration) bool {
+	return !created.IsZero() && time.Since(created) > d
+}
@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReconcile(t *testing.T) {
+	// "managed" was created by the broker and holds an instance's cluster,
+	// "orphan" was created by the broker but is no longer used and
+	// "foreign" was created outside the broker in the same org.
+	clusters := map[string][]string{
+		"managed": {"used", "old-orphan", "new-orphan", "manual"},
+		"orphan":  {},
+		"foreign": {"foreign-cluster"},
+	}
+
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			_, _ = w.Write([]byte("{}"))
+		case len(parts) == 2:
+			fmt.Fprintf(w, `{"id": %q, "orgId": "org"}`, parts[1])
+		default:
+			results := []string{}
+			for _, name := range clusters[parts[1]] {
+				results = append(results, fmt.Sprintf(`{"name": %q, "stateName": "IDLE"}`, name))
+			}
+			fmt.Fprintf(w, `{"results": [%s]}`, strings.Join(results, ","))
+		}
+	}))
+	defer server.Close()
+
+	key := credentials.APIKey{}
+	creds := &credentials.Credentials{
+		Orgs:     map[string]credentials.APIKey{"org": key},
+		Projects: map[string]credentials.APIKey{"managed": key, "orphan": key, "foreign": key},
+	}
+
+	ctx := context.Background()
+	b := &Broker{
+		logger:      zap.NewNop().Sugar(),
+		credentials: creds,
+		baseURL:     server.URL + "/",
+		state:       NewMemoryStateStore(),
+	}
+
+	old := time.Now().Add(-2 * reconcileGracePeriod)
+	op, err := b.startOperation(ctx, "in-flight", OperationProvision)
+	assert.NoError(t, err)
+
+	// Instances still being provisioned are recorded before their cluster
+	// exists and must not be mistaken for stale ones.
+	for _, s := range []serviceInstance{
+		{ID: "instance", ClusterNames: []string{"used"}},
+		{ID: "stale", ClusterNames: []string{"gone"}, Created: old},
+		{ID: "provisioning", ClusterNames: []string{"pending"}, Created: time.Now()},
+		{ID: "in-flight", ClusterNames: []string{"requested"}, Created: old, OperationID: op.ID},
+	} {
+		s.Parameters = map[string]interface{}{"groupID": "managed", "clusterName": s.ClusterNames[0]}
+		assert.NoError(t, b.state.Put(ctx, instancesCollection, s.ID, s))
+	}
+
+	for _, r := range []managedResource{
+		{GroupID: "managed", Created: old},
+		{GroupID: "managed", ClusterName: "used", Created: old},
+		{GroupID: "managed", ClusterName: "old-orphan", Created: old},
+		{GroupID: "managed", ClusterName: "new-orphan", Created: time.Now()},
+		{GroupID: "orphan", Created: old},
+	} {
+		r.ID = managedID(r.GroupID, r.ClusterName)
+		assert.NoError(t, b.state.Put(ctx, managedCollection, r.ID, r))
+	}
+
+	findings, err := b.Reconcile(ctx, false)
+	assert.NoError(t, err)
+
+	fixable := map[string]bool{}
+	for _, f := range findings {
+		fixable[f.Kind+" "+managedID(f.GroupID, f.ClusterName)] = f.Fixable
+	}
+	assert.Equal(t, map[string]bool{
+		"orphaned-cluster managed/old-orphan":      true,
+		"orphaned-cluster managed/new-orphan":      false,
+		"orphaned-cluster managed/manual":          false,
+		"orphaned-cluster foreign/foreign-cluster": false,
+		"orphaned-project orphan":                  true,
+		"stale-instance managed/gone":              true,
+	}, fixable)
+	assert.Empty(t, deleted)
+
+	_, err = b.Reconcile(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/groups/managed/clusters/old-orphan"}, deleted)
+
+	ids, err := b.state.IDs(ctx, instancesCollection)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"instance", "provisioning", "in-flight"}, ids)
+
+	queued, err := b.queuedProjectDeletions(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"orphan": true}, queued)
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// templateReloadDelay is how long the template watcher waits for further
+// changes before reloading. Editors and ConfigMap updates usually produce a
+// burst of events for a single change.
+const templateReloadDelay = 2 * time.Second
+
+// ReloadCatalog rebuilds the service catalog from the plan templates and
+// swaps it in atomically. If the templates are invalid the catalog in use is
+// kept and the error is returned.
+func (b *Broker) ReloadCatalog() error {
+	c, err := b.buildCatalog()
+	if err != nil {
+		b.logger.Errorw("Cannot reload service catalog, keeping the last good catalog", "error", err)
+		return err
+	}
+
+	b.currentCatalog.Store(c)
+	b.logger.Infow("Reloaded service catalog", "plans", len(c.plans))
+	return nil
+}
+
+// WatchTemplates reloads the service catalog whenever the plan template
+// directory changes, until the context is cancelled.
+func (b *Broker) WatchTemplates(ctx context.Context, dir string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	b.logger.Infow("Watching plan templates", "dir", dir)
+
+	go func() {
+		defer w.Close()
+
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				b.logger.Debugw("Plan template directory changed", "event", e.String())
+				reload = time.After(templateReloadDelay)
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				b.logger.Errorw("Error while watching plan templates", "error", err, "dir", dir)
+
+			case <-reload:
+				reload = nil
+				_ = b.ReloadCatalog()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// PollTemplates reloads the service catalog periodically, for template
+// sources which can't be watched, until the context is cancelled.
+func (b *Broker) PollTemplates(ctx context.Context, interval time.Duration) {
+	b.logger.Infow("Polling plan templates", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = b.ReloadCatalog()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReloadCatalog(t *testing.T) {
+	dir := useTestTemplateDir(t)
+
+	writeTestTemplate(t, dir, "first", fmt.Sprintf(testPlanTemplate, "first"))
+
+	b := New(zap.NewNop().Sugar(), nil, "", nil, nil, NewMemoryStateStore(), DynamicPlans)
+	assert.Len(t, b.getCatalog().plans, 1)
+
+	// A broken template keeps the last good catalog.
+	writeTestTemplate(t, dir, "broken", "name: {{ .name")
+	assert.Error(t, b.ReloadCatalog())
+	assert.Len(t, b.getCatalog().plans, 1)
+
+	writeTestTemplate(t, dir, "broken", fmt.Sprintf(testPlanTemplate, "second"))
+	assert.NoError(t, b.ReloadCatalog())
+	assert.Len(t, b.getCatalog().plans, 2)
+}
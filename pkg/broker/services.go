@@ -1,12 +1,14 @@
 package broker
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"net/url"
+	"reflect"
 	"regexp"
 	"strings"
+	"time"
+
 	"github.com/goccy/go-yaml"
 	atlasprivate "github.com/mongodb/mongodb-atlas-service-broker/pkg/atlas"
 	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
@@ -50,30 +52,76 @@ var (
 )
 
 type serviceInstance struct {
-	ID string `bson:"id"`
+	ID string `bson:"id" json:"id"`
 	domain.GetInstanceDetailsSpec
+
+	// RawParameters and OperationID record the provision request so a
+	// retried request can be answered with the original result.
+	RawParameters string `bson:"rawParameters,omitempty" json:"rawParameters,omitempty"`
+	OperationID   string `bson:"operationID,omitempty" json:"operationID,omitempty"`
+
+	// Created is when the instance was first recorded. Records written by
+	// older broker versions don't have it.
+	Created time.Time `bson:"created,omitempty" json:"created,omitempty"`
+
+	// PlanVersion is the version of the plan template the instance was
+	// last provisioned or upgraded from.
+	PlanVersion string `bson:"planVersion,omitempty" json:"planVersion,omitempty"`
+
+	// ClusterNames lists every cluster of the instance, the primary cluster
+	// recorded as clusterName first. Instances with a single cluster may
+	// not have it set.
+	ClusterNames []string `bson:"clusterNames,omitempty" json:"clusterNames,omitempty"`
+
+	// CustomDBRoles and AlertConfigIDs record the custom roles and alert
+	// configurations created from the plan, so updates only touch those.
+	CustomDBRoles  []string `bson:"customDBRoles,omitempty" json:"customDBRoles,omitempty"`
+	AlertConfigIDs []string `bson:"alertConfigIDs,omitempty" json:"alertConfigIDs,omitempty"`
+
+	// The network resources created from the plan, removed again when the
+	// instance is deprovisioned.
+	ContainerIDs       []string `bson:"containerIDs,omitempty" json:"containerIDs,omitempty"`
+	PeerIDs            []string `bson:"peerIDs,omitempty" json:"peerIDs,omitempty"`
+	PrivateEndpointIDs []string `bson:"privateEndpointIDs,omitempty" json:"privateEndpointIDs,omitempty"`
+
+	// TeamIDs records the teams added to the project from the plan, so
+	// teams dropped from the plan can be removed again.
+	TeamIDs []string `bson:"teamIDs,omitempty" json:"teamIDs,omitempty"`
+
+	// The Atlas org and the platform tenant the instance belongs to, which
+	// instance quotas are counted by.
+	OrgID     string `bson:"orgID,omitempty" json:"orgID,omitempty"`
+	Namespace string `bson:"namespace,omitempty" json:"namespace,omitempty"`
+	CFOrg     string `bson:"cfOrg,omitempty" json:"cfOrg,omitempty"`
 }
 
 // Services generates the service catalog which will be presented to consumers of the API.
 func (b *Broker) Services(ctx context.Context) ([]domain.Service, error) {
 	b.logger.Info("Retrieving service catalog")
-	return b.catalog.services, nil
+	return b.getCatalog().services, nil
 }
 
-func (b *Broker) buildCatalog() error {
-	b.catalog = newCatalog()
+// buildCatalog builds a new service catalog. In Dynamic Plans mode it fails
+// if any of the plan templates is invalid.
+func (b *Broker) buildCatalog() (*catalog, error) {
+	c := newCatalog()
 
 	if b.mode == DynamicPlans {
-		svc := b.buildServiceTemplate()
-
-		for _, p := range svc.Plans {
-			b.catalog.plans[p.ID] = p
+		services, err := b.buildServicesDynamic()
+		if err != nil {
+			return nil, err
 		}
 
-		b.catalog.providers[svc.ID] = atlasprivate.Provider{Name: "template"}
-		b.catalog.services = append(b.catalog.services, svc)
-		b.logger.Infow("Built service", "provider", "template")
-		return nil
+		for _, svc := range services {
+			for _, p := range svc.Plans {
+				c.plans[p.ID] = p
+			}
+
+			c.providers[svc.ID] = atlasprivate.Provider{Name: "template"}
+			c.services = append(c.services, svc)
+			b.logger.Infow("Built service", "provider", "template", "service", svc.Name)
+		}
+		return c, nil
 	}
 
 	for _, providerName := range providerNames {
@@ -92,26 +140,26 @@ func (b *Broker) buildCatalog() error {
 			u.Path = ""
 			provider, err := atlasprivate.NewClient(u.String(), "", "", "").GetProvider(providerName)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			svc = b.buildService(provider)
-			b.catalog.providers[svc.ID] = *provider
+			c.providers[svc.ID] = *provider
 		}
 
 		if b.whitelist != nil {
-			svc.Plans = b.catalog.applyWhitelist(svc.Plans, whitelistedPlans)
+			svc.Plans = c.applyWhitelist(svc.Plans, whitelistedPlans)
 		}
 
 		for _, p := range svc.Plans {
-			b.catalog.plans[p.ID] = p
+			c.plans[p.ID] = p
 		}
 
-		b.catalog.services = append(b.catalog.services, svc)
+		c.services = append(c.services, svc)
 		b.logger.Infow("Built service", "provider", providerName)
 	}
 
-	return nil
+	return c, nil
 }
 
 func (b *Broker) buildService(provider *atlasprivate.Provider) (service domain.Service) {
@@ -136,26 +184,97 @@ func (b *Broker) buildService(provider *atlasprivate.Provider) (service domain.S
 	return service
 }
 
-func (b *Broker) buildServiceTemplate() (service domain.Service) {
+// templateService is the service plans without a service block are offered
+// under.
+func templateService() domain.Service {
 	return domain.Service{
 		ID:                   serviceIDForProvider("template"),
 		Name:                 "mongodb-atlas-template",
 		Description:          "MonogoDB Atlas Plan Template Deployments",
 		Bindable:             true,
 		InstancesRetrievable: true,
-		BindingsRetrievable:  false,
-		Metadata:             &domain.ServiceMetadata{
-            DisplayName:      "MongoDB Atlas - Template Services",
-            ImageUrl:         "https://webassets.mongodb.com/_com_assets/cms/vectors-anchor-circle-mydmar539a.svg",
-            DocumentationUrl: "https://support.mongodb.com/welcome",
-            ProviderDisplayName: "MongoDB",
-            LongDescription:  "Complete MongoDB Atlas deployments managed through resource templates. See https://github.com/jasonmimick/atlas-osb",
-        },
+		BindingsRetrievable:  true,
+		Metadata: &domain.ServiceMetadata{
+			DisplayName:         "MongoDB Atlas - Template Services",
+			ImageUrl:            "https://webassets.mongodb.com/_com_assets/cms/vectors-anchor-circle-mydmar539a.svg",
+			DocumentationUrl:    "https://support.mongodb.com/welcome",
+			ProviderDisplayName: "MongoDB",
+			LongDescription:     "Complete MongoDB Atlas deployments managed through resource templates.",
+		},
+		PlanUpdatable: true,
+	}
+}
+
+// serviceForPlan returns the catalog service declared by a plan's service
+// block. The service ID defaults to one derived from its name, and services
+// are bindable and allow plan updates unless they say otherwise.
+func serviceForPlan(p dynamicplans.Plan) domain.Service {
+	if p.Service == nil {
+		return templateService()
+	}
+
+	svc := domain.Service{
+		ID:                   p.Service.ID,
+		Name:                 p.Service.Name,
+		Description:          p.Service.Description,
+		Bindable:             true,
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
+		Tags:                 p.Service.Tags,
+		Metadata:             p.Service.Metadata,
 		PlanUpdatable:        true,
-		Plans:                b.buildPlansForProviderDynamic(),
 	}
+
+	if svc.ID == "" {
+		svc.ID = serviceIDForProvider(p.Service.Name)
+	}
+	if p.Service.Bindable != nil {
+		svc.Bindable = *p.Service.Bindable
+	}
+	if p.Service.PlanUpdateable != nil {
+		svc.PlanUpdatable = *p.Service.PlanUpdateable
+	}
+
+	return svc
 }
 
+// buildServicesDynamic renders the plan templates and groups the resulting
+// plans into catalog services, in the order the services first appear. All
+// plans of a service must declare it the same way, and plan IDs must be
+// unique across the catalog.
+func (b *Broker) buildServicesDynamic() ([]domain.Service, error) {
+	plans, err := b.buildPlansForProviderDynamic()
+	if err != nil {
+		return nil, err
+	}
+
+	services := []domain.Service{}
+	index := map[string]int{}
+	declared := map[string]dynamicPlan{}
+	ids := map[string]string{}
+	for _, dp := range plans {
+		// Requests for a plan ID can only ever resolve to one plan.
+		if other, ok := ids[dp.servicePlan.ID]; ok {
+			return nil, fmt.Errorf("templates %q and %q result in the same plan ID %q", other, dp.template, dp.servicePlan.ID)
+		}
+		ids[dp.servicePlan.ID] = dp.template
+
+		svc := serviceForPlan(dp.plan)
+
+		if other, ok := declared[svc.ID]; !ok {
+			declared[svc.ID] = dp
+			index[svc.ID] = len(services)
+			services = append(services, svc)
+		} else if !reflect.DeepEqual(other.plan.Service, dp.plan.Service) {
+			return nil, fmt.Errorf("template %q declares service %q differently than template %q", dp.template, svc.ID, other.template)
+		}
+
+		i := index[svc.ID]
+		services[i].Plans = append(services[i].Plans, dp.servicePlan)
+	}
+
+	return services, nil
+}
 
 // plansForProvider will convert the available instance sizes for a provider
 // to service plans for the broker.
@@ -200,7 +319,7 @@ func (b *Broker) buildPlansForProviderAuto(provider *atlasprivate.Provider) []do
 	var plans []domain.ServicePlan
 
 	for _, instanceSize := range provider.InstanceSizes {
-		for groupID, key := range b.credentials.Projects {
+		for groupID, key := range b.credentials.ProjectKeys() {
 			id := groupID
 			if key.Desc != "" {
 				id = normalizeID(key.Desc)
@@ -224,57 +343,50 @@ func (b *Broker) buildPlansForProviderAuto(provider *atlasprivate.Provider) []do
 	return plans
 }
 
-func (b *Broker) buildPlansForProviderDynamic() []domain.ServicePlan {
-	var plans []domain.ServicePlan
+// buildPlansForProviderDynamic renders the plan templates into service
+// plans. Any template which cannot be rendered or decoded, or has no
+// cluster to list, is an error, so a broken template never silently drops
+// a plan from the catalog.
+func (b *Broker) buildPlansForProviderDynamic() ([]dynamicPlan, error) {
+	var plans []dynamicPlan
 
 	templates, err := dynamicplans.FromEnv()
 	if err != nil {
-		b.logger.Fatalw("could not read dynamic plans from environment", "error", err)
-	}
-
-	planContext := dynamicplans.Context{
-		"credentials": b.credentials,
+		return nil, fmt.Errorf("could not read dynamic plans from environment: %v", err)
 	}
 
 	for _, template := range templates {
-		raw := new(bytes.Buffer)
-
-		err := template.Execute(raw, planContext)
+		raw, err := dynamicplans.Render(template, dynamicplans.Context{}, dynamicplans.RenderOptions{Credentials: b.credentials})
 		if err != nil {
-			b.logger.Errorf("cannot execute template %q: %v", template.Name(), err)
-			continue
+			return nil, fmt.Errorf("cannot execute template %q: %v", template.Name(), err)
 		}
 
-		b.logger.Infof("Parsed plan: %s", raw.String())
+		b.logger.Debugw("Rendered plan for catalog", "template", template.Name())
 
 		p := dynamicplans.Plan{}
 		if err := yaml.NewDecoder(raw).Decode(&p); err != nil {
-			b.logger.Errorw("cannot decode yaml template", "name", template.Name(), "error", err)
-			continue
+			return nil, fmt.Errorf("cannot decode yaml template %q: %v", template.Name(), err)
 		}
 
-		if p.Cluster == nil ||
-			p.Cluster.ProviderSettings == nil {
-			if p.Cluster.ProviderSettings.ProviderName == "" {
-				b.logger.Errorw(
-					"invalid yaml template",
-					"name", template.Name(),
-					"error", ".cluster.providerSettings.providerName must not be empty",
-				)
-				continue
-			}
-			if p.Cluster.ProviderSettings.InstanceSizeName == "" {
-				b.logger.Errorw(
-					"invalid yaml template",
-					"name", template.Name(),
-					"error", ".cluster.providerSettings.instanceSizeName must not be empty",
-				)
-				continue
-			}
+		clusters := p.AllClusters()
+		if len(clusters) == 0 || clusters[0].ProviderSettings == nil {
+			return nil, fmt.Errorf("invalid yaml template %q: the plan must have a cluster with providerSettings", template.Name())
+		}
+
+		// Parameters must not pass validation only because the schema uses
+		// keywords the broker can't check.
+		if err := p.Parameters.Check(); err != nil {
+			return nil, fmt.Errorf("invalid yaml template %q: .parameters: %v", template.Name(), err)
+		}
+
+		// Other problems don't keep the plan from being listed, they are
+		// left to "plans lint" and only logged here.
+		for _, issue := range checkPlan(&p, false) {
+			b.logger.Warnw("Plan template has problems, check it with \"plans lint\"", "template", template.Name(), "problem", issue.message)
 		}
 
 		plan := domain.ServicePlan{
-			ID:          planIDForDynamicPlan("template", p.Name),
+			ID:          dynamicPlanID(p),
 			Name:        p.Name,
 			Description: p.Description,
 			Free:        p.Free,
@@ -283,15 +395,52 @@ func (b *Broker) buildPlansForProviderDynamic() []domain.ServicePlan {
                 Bullets:            []string{ p.Description }, 
 				AdditionalMetadata: map[string]interface{}{
 					"template":     dynamicplans.TemplateContainer{Template: template},
-					"instanceSize": p.Cluster.ProviderSettings.InstanceSizeName,
+					"instanceSize": clusters[0].ProviderSettings.InstanceSizeName,
 				},
 			},
 		}
-		plans = append(plans, plan)
-		continue
+		plan.Schemas = schemasForPlan(p.Parameters)
+		plan.MaintenanceInfo = maintenanceInfoForPlan(p)
+
+		plans = append(plans, dynamicPlan{template: template.Name(), plan: p, servicePlan: plan})
 	}
 
-	return plans
+	return plans, nil
+}
+
+// dynamicPlan is a plan rendered from a template for the catalog.
+type dynamicPlan struct {
+	template    string
+	plan        dynamicplans.Plan
+	servicePlan domain.ServicePlan
+}
+
+// dynamicPlanID returns the catalog ID of a dynamic plan. Plans of the
+// default template service keep the IDs they had before plans could
+// declare their service.
+func dynamicPlanID(p dynamicplans.Plan) string {
+	if p.Service != nil {
+		return planIDForDynamicPlan(p.Service.Name, p.Name)
+	}
+	return planIDForDynamicPlan("template", p.Name)
+}
+
+// schemasForPlan converts the parameter schemas of a dynamic plan into the
+// schemas published in the catalog.
+func schemasForPlan(p *dynamicplans.PlanParameters) *domain.ServiceSchemas {
+	if p == nil {
+		return nil
+	}
+
+	return &domain.ServiceSchemas{
+		Instance: domain.ServiceInstanceSchema{
+			Create: domain.Schema{Parameters: p.Create.Normalize()},
+			Update: domain.Schema{Parameters: p.Update.Normalize()},
+		},
+		Binding: domain.ServiceBindingSchema{
+			Create: domain.Schema{Parameters: p.Bind.Normalize()},
+		},
+	}
 }
 
 // serviceIDForProvider will generate a globally unique ID for a provider.
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const testServiceBlock = `service:
+  name: mongodb-dev
+  description: Development databases
+  tags: [mongodb, dev]
+  plan_updateable: false
+`
+
+func TestBuildServicesDynamic(t *testing.T) {
+	dir := useTestTemplateDir(t)
+
+	writeTestTemplate(t, dir, "a", testServiceBlock+fmt.Sprintf(testPlanTemplate, "small"))
+	writeTestTemplate(t, dir, "b", fmt.Sprintf(testPlanTemplate, "small"))
+	writeTestTemplate(t, dir, "c", testServiceBlock+fmt.Sprintf(testPlanTemplate, "large"))
+
+	b := New(zap.NewNop().Sugar(), nil, "", nil, nil, NewMemoryStateStore(), DynamicPlans)
+	c := b.getCatalog()
+	assert.Len(t, c.plans, 3)
+
+	if assert.Len(t, c.services, 2) {
+		dev := c.services[0]
+		assert.Equal(t, serviceIDForProvider("mongodb-dev"), dev.ID)
+		assert.Equal(t, "mongodb-dev", dev.Name)
+		assert.Equal(t, []string{"mongodb", "dev"}, dev.Tags)
+		assert.True(t, dev.Bindable)
+		assert.False(t, dev.PlanUpdatable)
+		assert.Len(t, dev.Plans, 2)
+
+		assert.Equal(t, "mongodb-atlas-template", c.services[1].Name)
+		assert.Len(t, c.services[1].Plans, 1)
+		assert.NotEqual(t, dev.Plans[0].ID, c.services[1].Plans[0].ID)
+	}
+
+	// Plans can't disagree on the service they share.
+	writeTestTemplate(t, dir, "c", "service:\n  name: mongodb-dev\n"+fmt.Sprintf(testPlanTemplate, "large"))
+	assert.Error(t, b.ReloadCatalog())
+
+	// Problems left to the linter don't drop a plan from the catalog, a
+	// plan without a cluster does.
+	writeTestTemplate(t, dir, "c", testServiceBlock+fmt.Sprintf(testPlanTemplate, "large")+"version: one\n")
+	assert.NoError(t, b.ReloadCatalog())
+	assert.Len(t, b.getCatalog().plans, 3)
+
+	writeTestTemplate(t, dir, "c", testServiceBlock+"name: large\ndescription: Test plan\n")
+	assert.Error(t, b.ReloadCatalog())
+
+	// Plans with the same ID keep the last good catalog.
+	writeTestTemplate(t, dir, "c", testServiceBlock+fmt.Sprintf(testPlanTemplate, "large"))
+	writeTestTemplate(t, dir, "d", fmt.Sprintf(testPlanTemplate, "small"))
+	err := b.ReloadCatalog()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "same plan ID")
+	}
+	assert.Len(t, b.getCatalog().plans, 3)
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// Collections used by the broker to persist its metadata.
+const (
+	instancesCollection    = "instances"
+	bindingsCollection     = "bindings"
+	operationsCollection   = "operations"
+	cleanupTasksCollection = "cleanupTasks"
+	managedCollection      = "managedResources"
+)
+
+// ErrStateNotFound is returned by a StateStore when the requested record
+// does not exist.
+var ErrStateNotFound = errors.New("state record not found")
+
+// StateStore persists broker metadata such as service instance records.
+// Records are grouped into collections and addressed by ID. Every record
+// stored must carry its ID in a field tagged `bson:"id" json:"id"` so it can
+// be looked up by all backends.
+type StateStore interface {
+	// Get decodes the record with the given ID into out. It returns
+	// ErrStateNotFound if the record does not exist.
+	Get(ctx context.Context, collection string, id string, out interface{}) error
+
+	// Put inserts or replaces the record with the given ID.
+	Put(ctx context.Context, collection string, id string, in interface{}) error
+
+	// Delete removes the record with the given ID. Deleting a record that
+	// does not exist is not an error.
+	Delete(ctx context.Context, collection string, id string) error
+
+	// IDs lists the IDs of all records in a collection.
+	IDs(ctx context.Context, collection string) ([]string, error)
+}
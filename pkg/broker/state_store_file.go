@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewFileStateStore creates a StateStore which keeps all records in memory
+// and writes them to a single JSON file on every modification. Existing
+// records are loaded from the file if it exists.
+func NewFileStateStore(path string) (StateStore, error) {
+	records := stateRecords{}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		// start with an empty store
+	case err != nil:
+		return nil, err
+	case len(data) > 0:
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("cannot parse state file %q: %v", path, err)
+		}
+	}
+
+	return &memoryStateStore{
+		records: records,
+		persist: func(r stateRecords) error {
+			return writeStateFile(path, r)
+		},
+	}, nil
+}
+
+// writeStateFile atomically replaces the state file by writing to a
+// temporary file in the same directory and renaming it.
+func writeStateFile(path string, records stateRecords) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// Ensure memoryStateStore adheres to the StateStore interface.
+var _ StateStore = new(memoryStateStore)
+
+// stateRecords holds JSON encoded records by collection and ID.
+type stateRecords map[string]map[string]json.RawMessage
+
+// memoryStateStore keeps broker metadata in memory. Records are stored JSON
+// encoded so callers never share state with the store.
+type memoryStateStore struct {
+	mu      sync.RWMutex
+	records stateRecords
+
+	// persist is called with the lock held after every modification. If it
+	// fails the modification is rolled back.
+	persist func(stateRecords) error
+}
+
+// NewMemoryStateStore creates a StateStore which keeps all records in
+// memory. All state is lost when the broker stops.
+func NewMemoryStateStore() StateStore {
+	return &memoryStateStore{
+		records: stateRecords{},
+	}
+}
+
+func (s *memoryStateStore) Get(ctx context.Context, collection string, id string, out interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	raw, ok := s.records[collection][id]
+	if !ok {
+		return ErrStateNotFound
+	}
+
+	return json.Unmarshal(raw, out)
+}
+
+func (s *memoryStateStore) Put(ctx context.Context, collection string, id string, in interface{}) error {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.records[collection]
+	if !ok {
+		c = map[string]json.RawMessage{}
+		s.records[collection] = c
+	}
+
+	old, existed := c[id]
+	c[id] = raw
+
+	if err := s.save(); err != nil {
+		if existed {
+			c[id] = old
+		} else {
+			delete(c, id)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *memoryStateStore) Delete(ctx context.Context, collection string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.records[collection][id]
+	if !ok {
+		return nil
+	}
+
+	delete(s.records[collection], id)
+
+	if err := s.save(); err != nil {
+		s.records[collection][id] = old
+		return err
+	}
+
+	return nil
+}
+
+func (s *memoryStateStore) IDs(ctx context.Context, collection string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.records[collection]))
+	for id := range s.records[collection] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *memoryStateStore) save() error {
+	if s.persist == nil {
+		return nil
+	}
+
+	return s.persist(s.records)
+}
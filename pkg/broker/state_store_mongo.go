@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoDatabase is the database holding all broker collections.
+const mongoDatabase = "atlas-broker"
+
+// Ensure mongoStateStore adheres to the StateStore interface.
+var _ StateStore = new(mongoStateStore)
+
+// mongoStateStore keeps broker metadata in a MongoDB database, one
+// collection per record type.
+type mongoStateStore struct {
+	db *mongo.Database
+}
+
+// NewMongoStateStore creates a StateStore backed by an already connected
+// MongoDB client.
+func NewMongoStateStore(client *mongo.Client) StateStore {
+	return &mongoStateStore{
+		db: client.Database(mongoDatabase),
+	}
+}
+
+func (s *mongoStateStore) Get(ctx context.Context, collection string, id string, out interface{}) error {
+	err := s.db.Collection(collection).FindOne(ctx, bson.M{"id": id}).Decode(out)
+	if err == mongo.ErrNoDocuments {
+		return ErrStateNotFound
+	}
+
+	return err
+}
+
+func (s *mongoStateStore) Put(ctx context.Context, collection string, id string, in interface{}) error {
+	_, err := s.db.Collection(collection).ReplaceOne(ctx, bson.M{"id": id}, in, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStateStore) Delete(ctx context.Context, collection string, id string) error {
+	_, err := s.db.Collection(collection).DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (s *mongoStateStore) IDs(ctx context.Context, collection string) ([]string, error) {
+	values, err := s.db.Collection(collection).Distinct(ctx, "id", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		id, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("record ID in collection %q has the wrong type %T", collection, v)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
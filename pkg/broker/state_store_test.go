@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecord struct {
+	ID    string `bson:"id" json:"id"`
+	Value string `bson:"value" json:"value"`
+}
+
+func testStateStore(t *testing.T, s StateStore) {
+	ctx := context.Background()
+
+	err := s.Get(ctx, "test", "missing", &testRecord{})
+	assert.Equal(t, ErrStateNotFound, err)
+
+	assert.NoError(t, s.Put(ctx, "test", "a", testRecord{ID: "a", Value: "first"}))
+	assert.NoError(t, s.Put(ctx, "test", "b", testRecord{ID: "b", Value: "second"}))
+	assert.NoError(t, s.Put(ctx, "test", "a", testRecord{ID: "a", Value: "replaced"}))
+
+	r := testRecord{}
+	assert.NoError(t, s.Get(ctx, "test", "a", &r))
+	assert.Equal(t, testRecord{ID: "a", Value: "replaced"}, r)
+
+	ids, err := s.IDs(ctx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	assert.NoError(t, s.Delete(ctx, "test", "a"))
+	assert.NoError(t, s.Delete(ctx, "test", "a"))
+	assert.Equal(t, ErrStateNotFound, s.Get(ctx, "test", "a", &r))
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testStateStore(t, NewMemoryStateStore())
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewFileStateStore(path)
+	assert.NoError(t, err)
+	testStateStore(t, s)
+
+	// Records must survive reopening the store.
+	s, err = NewFileStateStore(path)
+	assert.NoError(t, err)
+
+	r := testRecord{}
+	assert.NoError(t, s.Get(context.Background(), "test", "b", &r))
+	assert.Equal(t, testRecord{ID: "b", Value: "second"}, r)
+}
@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPlanTemplate = `name: %s
+description: Test plan
+cluster:
+  providerSettings:
+    providerName: AWS
+    instanceSizeName: M10
+    regionName: US_EAST_1
+`
+
+// useTestTemplateDir creates an empty template directory and points the
+// broker at it for the rest of the test. The directory is removed and the
+// environment restored once the test is done.
+func useTestTemplateDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "templates")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	previous, ok := os.LookupEnv(dynamicplans.TemplateDirEnv)
+	os.Setenv(dynamicplans.TemplateDirEnv, dir)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(dynamicplans.TemplateDirEnv, previous)
+		} else {
+			os.Unsetenv(dynamicplans.TemplateDirEnv)
+		}
+	})
+
+	return dir
+}
+
+func writeTestTemplate(t *testing.T, dir string, name string, text string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(filepath.Join(dir, name+".yml.tpl"), []byte(text), 0644)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/credentials"
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker/dynamicplans"
+)
+
+// lintOrgID is the org ID used in the default sample context when no
+// credentials are configured.
+const lintOrgID = "000000000000000000000000"
+
+// contextFiles collects the repeated --context flag.
+type contextFiles []string
+
+func (c *contextFiles) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *contextFiles) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// runPlans implements the "plans" command and its subcommands.
+func runPlans(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: atlas-osb plans lint [--dir DIR] [--context FILE]...")
+		fmt.Fprintln(os.Stderr, "       atlas-osb plans render PLAN [--dir DIR] [--params FILE] [--context FILE] [--instance-id ID]")
+		return 2
+	}
+
+	switch args[0] {
+	case "lint":
+		return runPlansLint(args[1:])
+	case "render":
+		return runPlansRender(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown plans command %q\n", args[0])
+		return 2
+	}
+}
+
+// runPlansLint renders and checks all plan templates of a directory, or of
+// the template source configured in the environment, without contacting
+// Atlas. It prints every problem found and returns a non-zero exit code if
+// there are any.
+func runPlansLint(args []string) int {
+	fs := flag.NewFlagSet("plans lint", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory containing the plan templates. Defaults to the template source configured in the environment.")
+	var files contextFiles
+	fs.Var(&files, "context", "JSON file with a sample provisioning context (parameters and platform context). Can be repeated.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var src dynamicplans.Source = dynamicplans.DirSource{Path: *dir}
+	if *dir == "" {
+		var err error
+		src, err = dynamicplans.SourceFromEnv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load template source: %v\n", err)
+			return 2
+		}
+	}
+
+	if src == nil {
+		fmt.Fprintln(os.Stderr, "No template source given, use --dir or configure one with "+dynamicplans.TemplateDirEnv+", "+dynamicplans.TemplateConfigMapEnv+", "+dynamicplans.TemplateURLsEnv+" or "+dynamicplans.TemplateGitEnv)
+		return 2
+	}
+
+	creds, err := lintCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load credentials: %v\n", err)
+		return 2
+	}
+
+	samples, err := lintSamples(files, creds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load sample context: %v\n", err)
+		return 2
+	}
+
+	issues, err := broker.LintTemplates(src, creds, samples)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot lint templates: %v\n", err)
+		return 2
+	}
+
+	for _, i := range issues {
+		fmt.Println(i)
+	}
+
+	if len(issues) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(issues))
+		return 1
+	}
+	return 0
+}
+
+// runPlansRender prints a plan rendered the way provisioning would render
+// it, with secrets redacted. Nothing is sent to Atlas.
+func runPlansRender(args []string) int {
+	// The plan comes first, but flag parsing stops at the first argument.
+	plan := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		plan, args = args[0], args[1:]
+	}
+
+	defaultDir, _ := dynamicplans.DirFromEnv()
+
+	fs := flag.NewFlagSet("plans render", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "Directory containing the plan templates. Defaults to "+dynamicplans.TemplateDirEnv+".")
+	paramsFile := fs.String("params", "", "JSON file with the provision parameters.")
+	contextFile := fs.String("context", "", "JSON file with the platform context.")
+	instanceID := fs.String("instance-id", "", "Instance ID to render the plan for.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if plan == "" {
+		plan = fs.Arg(0)
+	}
+	if plan == "" || *dir == "" {
+		fmt.Fprintln(os.Stderr, "Usage: atlas-osb plans render PLAN [--dir DIR] [--params FILE] [--context FILE] [--instance-id ID]")
+		return 2
+	}
+
+	params, err := readOptionalFile(*paramsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read parameters: %v\n", err)
+		return 2
+	}
+
+	platformContext, err := readOptionalFile(*contextFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read context: %v\n", err)
+		return 2
+	}
+
+	creds, err := lintCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load credentials: %v\n", err)
+		return 2
+	}
+
+	// Keep the output clean, only warnings and errors are logged.
+	logger, err := createLogger("WARN")
+	if err != nil {
+		panic(err)
+	}
+
+	os.Setenv(dynamicplans.TemplateDirEnv, *dir)
+	b := broker.New(logger, creds, DefaultAtlasBaseURL, nil, nil, nil, broker.DynamicPlans)
+
+	dp, err := b.RenderPlan(plan, *instanceID, params, platformContext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot render plan: %v\n", err)
+		return 1
+	}
+
+	out, err := json.MarshalIndent(dp, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot encode plan: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(string(out))
+	return 0
+}
+
+// readOptionalFile reads a file if a path is given.
+func readOptionalFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// lintCredentials returns the credentials from BROKER_APIKEYS if set, and
+// placeholder credentials otherwise so templates referring to them render.
+func lintCredentials() (*credentials.Credentials, error) {
+	creds, err := credentials.FromEnv()
+	if err != nil || creds != nil {
+		return creds, err
+	}
+
+	return &credentials.Credentials{
+		Projects: map[string]credentials.APIKey{},
+		Orgs: map[string]credentials.APIKey{
+			lintOrgID: {},
+		},
+		Broker: &credentials.BrokerAuth{},
+	}, nil
+}
+
+// lintSamples loads the sample contexts given on the command line. Without
+// any, a single sample resembling a typical provision request is used.
+func lintSamples(files []string, creds *credentials.Credentials) ([]dynamicplans.Context, error) {
+	if len(files) == 0 {
+		orgID := lintOrgID
+		for id := range creds.Orgs {
+			orgID = id
+			break
+		}
+
+		return []dynamicplans.Context{{
+			"instance_id":   "00000000-0000-0000-0000-000000000000",
+			"instance_name": "lint-instance",
+			"org_id":        orgID,
+		}}, nil
+	}
+
+	samples := []dynamicplans.Context{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx := dynamicplans.Context{}
+		if err := json.Unmarshal(data, &ctx); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		samples = append(samples, ctx)
+	}
+
+	return samples, nil
+}
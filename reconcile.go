@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mongodb/mongodb-atlas-service-broker/pkg/broker"
+	"go.uber.org/zap"
+)
+
+// runReconcile implements the "reconcile" command. It compares the state
+// store with Atlas, prints all findings and returns a non-zero exit code if
+// any finding is left unresolved.
+func runReconcile(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "Remove stale instance records, delete orphaned clusters and queue orphaned projects for deletion.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	logger, err := createLogger(getEnvOrDefault("BROKER_LOG_LEVEL", DefaultLogLevel))
+	if err != nil {
+		panic(err)
+	}
+
+	b := createBroker(logger)
+
+	findings, err := b.Reconcile(context.Background(), *fix)
+	if err != nil {
+		logger.Errorw("Reconciliation failed", "error", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tPROJECT\tCLUSTER\tINSTANCE\tFIXABLE\tFIXED\tREASON")
+
+	unresolved := 0
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%s\n", f.Kind, f.GroupID, f.ClusterName, f.InstanceID, f.Fixable, f.Fixed, f.Reason)
+		if !f.Fixed {
+			unresolved++
+		}
+	}
+	w.Flush()
+
+	if unresolved > 0 {
+		return 1
+	}
+	return 0
+}
+
+// startReconciler starts the periodic reconciliation job if
+// BROKER_RECONCILE_INTERVAL is set.
+func startReconciler(logger *zap.SugaredLogger, b *broker.Broker) {
+	value := getEnvOrDefault("BROKER_RECONCILE_INTERVAL", "")
+	if value == "" {
+		return
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		logger.Fatalw("Invalid reconciliation interval", "interval", value, "error", err)
+	}
+
+	fix := getEnvOrDefault("BROKER_RECONCILE_FIX", "") == "true"
+	go b.RunReconciler(context.Background(), interval, fix)
+}
@@ -0,0 +1,28 @@
+{{/* Blocks shared by the sample plans, see docs/custom-plans.md#partials-and-inheritance */}}
+{{ define "project" -}}
+apiKey: {{ orgKey (default "" .org_id) }}
+project:
+  name: {{ .instance_name }}
+  desc: Created from a template
+  orgId: {{ .org_id }}
+{{- end }}
+
+{{/* Called with a dict of the parameters and the default role database */}}
+{{ define "databaseUsers" -}}
+{{- $p := .params -}}
+databaseUsers:
+- username: {{ default "test-user" $p.username }}
+  password: {{ default "test-password" $p.password }}
+  databaseName: {{ default "admin" $p.auth_db }}
+  roles:
+  - roleName: {{ default "readWrite" $p.role }}
+    databaseName: {{ default .roleDB $p.role_db }}
+{{- end }}
+
+{{ define "ipWhitelists" -}}
+ipWhitelists:
+- ipAddress: "0.0.0.0/1"
+  comment: "everything"
+- ipAddress: "128.0.0.0/1"
+  comment: "everything"
+{{- end }}
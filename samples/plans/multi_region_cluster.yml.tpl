@@ -1,11 +1,7 @@
 name: multi-region-us
 description: "This is sample Plan, it extends the 'Basic Plan` to a multi-region database cluster."
 free: true
-apiKey: {{ mustToJson (index .credentials.Orgs (default "" .org_id)) }}
-project:
-  name: {{ .instance_name }}
-  desc: Created from a template
-  orgId: {{ .org_id }}
+{{ include "project" . }}
 cluster:
   name: {{ .instance_name }}
   clusterType: "REPLICASET"
@@ -31,15 +27,5 @@ cluster:
         electableNodes: 2
         priority: 5
         readOnlyNodes: 0
-databaseUsers:
-- username: {{ default "test-user" .username }}
-  password: {{ default "test-password" .password }}
-  databaseName: {{ default "admin" .auth_db }}
-  roles:
-  - roleName: {{ default "readWrite" .role }}
-    databaseName: {{ default "test" .role_db }}
-ipWhitelists:
-- ipAddress: "0.0.0.0/1"
-  comment: "everything"
-- ipAddress: "128.0.0.0/1"
-  comment: "everything"
+{{ include "databaseUsers" (dict "params" . "roleDB" "test") }}
+{{ include "ipWhitelists" . }}
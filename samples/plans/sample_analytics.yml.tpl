@@ -0,0 +1,23 @@
+name: analytics-plan
+description: A project with an OLTP cluster and a separate analytics cluster, 1 dbuser, and 1 secure connection.
+{{ include "project" . }}
+clusters:
+- name: {{ .instance_name }}
+  providerBackupEnabled: true
+  providerSettings:
+    providerName: {{ default "AWS" .provider }}
+    instanceSizeName: {{ default "M30" .instance_size }}
+    regionName: {{ default "US_EAST_1" .region }}
+- name: {{ .instance_name }}-bi
+  providerSettings:
+    providerName: {{ default "AWS" .provider }}
+    instanceSizeName: {{ default "M40" .analytics_instance_size }}
+    regionName: {{ default "US_EAST_1" .region }}
+databaseUsers:
+- username: {{ default "test-user" .username }}
+  password: {{ default "test-password" .password }}
+  databaseName: admin
+  roles:
+  - roleName: readWriteAnyDatabase
+    databaseName: admin
+{{ include "ipWhitelists" . }}
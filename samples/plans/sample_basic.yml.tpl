@@ -1,11 +1,7 @@
 name: basic-plan
 description: This is the `Basic Plan` template for 1 project, 1 cluster, 1 dbuser, and 1 secure connection.
 free: true
-apiKey: {{ mustToJson (index .credentials.Orgs (default "" .org_id)) }}
-project:
-  name: {{ .instance_name }}
-  desc: Created from a template
-  orgId: {{ .org_id }}
+{{ include "project" . }}
 cluster:
   name: {{ .instance_name }}
   providerBackupEnabled: {{ default "true" .backups }}
@@ -16,15 +12,34 @@ cluster:
   labels:
     - key: Infrastructure Tool
       value: MongoDB Atlas Service Broker
-databaseUsers:
-- username: {{ default "test-user" .username }}
-  password: {{ default "test-password" .password }}
-  databaseName: {{ default "admin" .auth_db }}
-  roles:
-  - roleName: {{ default "readWrite" .role }}
-    databaseName: {{ default "default" .role_db }}
-ipWhitelists:
-- ipAddress: "0.0.0.0/1"
-  comment: "everything"
-- ipAddress: "128.0.0.0/1"
-  comment: "everything"
+{{ include "databaseUsers" (dict "params" . "roleDB" "default") }}
+{{ include "ipWhitelists" . }}
+overridable:
+  - cluster.mongoDBMajorVersion
+parameters:
+  create:
+    type: object
+    properties:
+      instance_name:
+        type: string
+      org_id:
+        type: string
+      provider:
+        type: string
+        enum: [AWS, GCP, AZURE]
+      instance_size:
+        type: string
+      region:
+        type: string
+      backups:
+        type: [boolean, string]
+      username:
+        type: string
+      password:
+        type: string
+      auth_db:
+        type: string
+      role:
+        type: string
+      role_db:
+        type: string
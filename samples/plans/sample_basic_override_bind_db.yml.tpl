@@ -1,33 +1,10 @@
+extends: sample_basic
 name: override-bind-db-plan
 description: This is an extension of the `Basic Plan` template for 1 project, 1 cluster, 1 dbuser, and 1 secure connection. But it added the ability to override the bind db.
-free: true
-apiKey: {{ mustToJson (index .credentials.Orgs (default "" .org_id)) }}
 settings:
   overrideBindDB: "OriginalMongoDBTileForPCFDBName"
-  overrideBindDBRole: "readWrite" 
-project:
-  name: {{ .instance_name }}
-  desc: Created from a template
-  orgId: {{ .org_id }}
-cluster:
-  name: {{ .instance_name }}
-  providerBackupEnabled: {{ default "true" .backups }}
-  providerSettings:
-    providerName: {{ default "AWS" .provider }}
-    instanceSizeName: {{ default "M20" .instance_size }}
-    regionName: {{ default "US_EAST_1" .region }}
-  labels:
-    - key: Infrastructure Tool
-      value: MongoDB Atlas Service Broker
-databaseUsers:
-- username: {{ default "test-user" .username }}
-  password: {{ default "test-password" .password }}
-  databaseName: {{ default "admin" .auth_db }}
-  roles:
-  - roleName: {{ default "readWrite" .role }}
-    databaseName: {{ default "default" .role_db }}
-ipWhitelists:
-- ipAddress: "0.0.0.0/1"
-  comment: "everything"
-- ipAddress: "128.0.0.0/1"
-  comment: "everything"
+  overrideBindDBRole: "readWrite"
+overridable:
+  - cluster.mongoDBMajorVersion
+  - settings.overrideBindDB
+  - settings.overrideBindDBRole